@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+const ADMIN_USER_ENV_VAR = "FIFTYMM_ADMIN_USER"
+const ADMIN_PASS_ENV_VAR = "FIFTYMM_ADMIN_PASS"
+
+const ADMIN_CACHE_PURGE_ROUTE = "/_admin/cache/purge"
+
+// The admin endpoints are served on every domain and are protected by their own
+// basic auth credentials, set through the environment. They're disabled if
+// those aren't set.
+func (a *App) HasAdminAuth() bool {
+	return a.adminUser != "" && a.adminPass != ""
+}
+
+func (a *App) GetAuthUser() string {
+	return a.adminUser
+}
+
+func (a *App) GetAuthPass() string {
+	return a.adminPass
+}
+
+func (a *App) GetAuthUsers() map[string]string {
+	return nil
+}
+
+func (a *App) GetAuthMode() string {
+	return AUTH_MODE_BASIC
+}
+
+func (a *App) GetOidcConfig() *OidcConfig {
+	return nil
+}
+
+// All the configured sites, sorted by domain
+func (a *App) GetSites() []*Site {
+	sites := make([]*Site, 0)
+	for _, site := range a.getSites() {
+		sites = append(sites, site)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Domain < sites[j].Domain
+	})
+	return sites
+}
+
+// Purges the caches of a single album (site and album set), all the albums in a
+// site (only site set) or every album we know about (neither set).
+func handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if !app.HasAdminAuth() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Admin endpoints are disabled\n"))
+		return
+	}
+
+	if !checkAndRequireAuth(w, r, app) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	domain := r.FormValue("site")
+	albumPath := r.FormValue("album")
+
+	var albums []*Album
+	if domain == "" {
+		if albumPath != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("An album can only be purged along with its site\n"))
+			return
+		}
+		for _, site := range app.GetSites() {
+			albums = append(albums, site.GetAllAlbums()...)
+		}
+	} else {
+		site, err := app.SiteForDomain(domain)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		if albumPath == "" {
+			albums = site.GetAllAlbums()
+		} else if album, err := site.GetAlbumForPath(albumPath); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		} else {
+			albums = []*Album{album}
+		}
+	}
+
+	status := http.StatusOK
+	var report []byte
+	for _, album := range albums {
+		if err := album.PurgeCaches(); err != nil {
+			status = http.StatusInternalServerError
+			report = append(report, fmt.Sprintf("Unable to refresh album %s%s. Error: %s\n",
+				album.site.Domain, album.Path, err.Error())...)
+		} else {
+			report = append(report, fmt.Sprintf("Purged album %s%s\n", album.site.Domain, album.Path)...)
+		}
+	}
+
+	w.WriteHeader(status)
+	w.Write(report)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"html/template"
 	"net/url"
 	"strings"
 	"sync"
@@ -10,18 +11,20 @@ import (
 	"time"
 
 	"io/ioutil"
+	"log"
 	"math"
 
 	"bitbucket.org/zombiezen/cardcpx/natsort"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/go-ini/ini"
+	"github.com/russross/blackfriday/v2"
 	"gopkg.in/yaml.v2"
 )
 
-const CACHE_INTERVAL = 1 * time.Hour
+const CACHE_INTERVAL = 1 * time.Hour // default for all cache TTLs
 const ORDERING_YAML_NAME = "ordering.yaml"
+const ALBUM_YAML_NAME = "album.yaml"
+const ALBUM_DATE_FORMAT = "2 January 2006"
+const DEFAULT_MAX_ALBUM_KEYS = 10000
 
 type Album struct {
 	site *Site
@@ -29,28 +32,120 @@ type Album struct {
 	Path         string
 	BucketPrefix string
 
-	AuthUser string
-	AuthPass string
+	AuthUser      string
+	AuthPass      string
+	AuthUsersFile string
+	authUsers     map[string]string
+	AuthMode      string // the site's if empty
+
+	// override the site's OpenID Connect settings, see oidc.go
+	OidcIssuer         string
+	OidcClientId       string
+	OidcClientSecret   string
+	OidcAllowedEmails  []string `delim:","`
+	OidcAllowedDomains []string `delim:","`
+
+	// signs share links that get visitors past auth, see share.go
+	ShareSecret string
 
 	MetaTitle  string
 	AlbumTitle string
 
 	InIndex bool
 
+	// serve every folder under BucketPrefix as a child album at Path + folder name
+	SubAlbums bool
+
+	SortBy string // see sorting.go, ordering.yaml can override it
+
+	// offer all the album's photos as a single ZIP, see zip.go
+	AllowZipDownload bool
+	MaxZipSize       int64 // in MB
+
+	AllowOriginals bool // link photo pages to the full resolution files, see originals.go
+
+	// override the site's cache TTLs when set
+	KeyCacheTTL      time.Duration
+	OrderingCacheTTL time.Duration
+	NegativeCacheTTL time.Duration
+
 	KeyCache                           atomic.Value
 	OrderingCache                      atomic.Value
+	MetadataCache                      atomic.Value
+	SubAlbumCache                      atomic.Value // []*Album, refreshed along with the KeyCache
+	ObjectCache                        atomic.Value // map[string]*StorageObject by key, refreshed along with the KeyCache
+	SortedKeyCache                     atomic.Value // *sortedKeys, the photos in the KeyCache sorted, refreshed along with it
+	ExifCache                          map[string]*exifCacheEntry
 	LastKeyCacheUpdate                 time.Time
 	LastAlbumOrderingConfigCacheUpdate time.Time
+	LastAlbumMetadataCacheUpdate       time.Time
 
 	KeyCacheUpdateMutex                 sync.Mutex
 	AlbumAlbumOrderingConfigUpdateMutex sync.Mutex
+	AlbumMetadataUpdateMutex            sync.Mutex
+	ExifCacheMutex                      sync.Mutex
 }
 
 //this struct will store the _configuration_ as read from a yaml file
 type AlbumOrderingConfig struct {
 	Cover             string
 	Thumbnails        []string
-	Ordering          []string
+	Ordering          []OrderingEntry
+	Sort              string // how photos not in Ordering are sorted
+	negativeCacheThis bool
+}
+
+//an entry in the ordering section, either just the key of a photo or a map with
+//the key and the photo's title, caption and alt text.
+type OrderingEntry struct {
+	Key     string
+	Title   string
+	Caption string
+	Alt     string
+}
+
+func (e *OrderingEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.Key); err == nil {
+		return nil
+	}
+
+	type plainOrderingEntry OrderingEntry
+	return unmarshal((*plainOrderingEntry)(e))
+}
+
+func (c *AlbumOrderingConfig) GetOrderingKeys() []string {
+	keys := make([]string, 0, len(c.Ordering))
+	for _, entry := range c.Ordering {
+		keys = append(keys, entry.Key)
+	}
+	return keys
+}
+
+//the ordering entries by key, without leading slashes. Ordering files made by
+//flickr_to_50mm list every photo, so entries are looked up here rather than
+//searched for one photo at a time. The first entry for a key wins.
+func (c *AlbumOrderingConfig) GetOrderingEntries() map[string]OrderingEntry {
+	entries := make(map[string]OrderingEntry, len(c.Ordering))
+	for _, entry := range c.Ordering {
+		key := strings.TrimLeft(entry.Key, "/")
+		if _, ok := entries[key]; !ok {
+			entries[key] = entry
+		}
+	}
+	return entries
+}
+
+//album details photographers can set without access to the INI file, read
+//from an album.yaml next to the ordering.yaml. Anything set here takes
+//precedence over the INI file.
+type AlbumMetadata struct {
+	Title             string
+	MetaTitle         string    `yaml:"meta_title"`
+	Description       string    // markdown
+	StartDate         time.Time `yaml:"start_date"`
+	EndDate           time.Time `yaml:"end_date"`
+	Location          string
+	Hidden            bool // hides the album from the site index
 	negativeCacheThis bool
 }
 
@@ -59,7 +154,7 @@ type AlbumOrderingConfig struct {
 type AlbumOrdering struct {
 	Cover      Renderable
 	Thumbnails []Renderable
-	Ordering   []Renderable
+	Ordering   []*CaptionedPhoto
 }
 
 type GetFromKeyCacheResult struct {
@@ -67,6 +162,11 @@ type GetFromKeyCacheResult struct {
 	err  error
 }
 
+type GetFromMetadataCacheResult struct {
+	albumMetadata AlbumMetadata
+	err           error
+}
+
 type GetFromOrderingConfigCacheResult struct {
 	albumOrderingConfig AlbumOrderingConfig
 	err                 error
@@ -78,6 +178,13 @@ func NewAlbumFromConfig(section *ini.Section, s *Site) (*Album, error) {
 		return nil, err
 	}
 
+	if album.AuthUsersFile != "" {
+		var err error
+		if album.authUsers, err = LoadAuthUsersFile(album.AuthUsersFile); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := album.IsValid(); err != nil {
 		return nil, err
 	}
@@ -111,6 +218,39 @@ func (a *Album) IsValid() error {
 		return errors.New("'Path' is a required parameters that must have a valid value.")
 	}
 
+	if a.KeyCacheTTL < 0 || a.OrderingCacheTTL < 0 || a.NegativeCacheTTL < 0 {
+		return errors.New("KeyCacheTTL, OrderingCacheTTL and NegativeCacheTTL can't be negative")
+	}
+
+	if err := ValidatePasswordHash(a.AuthPass); err != nil {
+		return fmt.Errorf("AuthPass can't be used. Error: %s", err.Error())
+	}
+
+	if a.AuthMode != "" && !IsValidAuthMode(a.AuthMode) {
+		return fmt.Errorf("Unknown AuthMode '%s', valid options are basic, form and oidc", a.AuthMode)
+	}
+
+	if a.AuthMode == AUTH_MODE_OIDC {
+		if err := a.GetOidcConfig().IsValid(); err != nil {
+			return err
+		}
+	} else if a.AuthMode == "" && a.HasOwnAuth() && a.site.AuthMode == AUTH_MODE_OIDC {
+		return errors.New("Albums with their own AuthUser or AuthUsersFile on a site with AuthMode = oidc need their own AuthMode")
+	}
+
+	if a.ShareSecret != "" && len(a.ShareSecret) < MIN_SHARE_SECRET_LENGTH {
+		return fmt.Errorf("ShareSecret needs to be at least %d characters long", MIN_SHARE_SECRET_LENGTH)
+	}
+
+	if a.MaxZipSize < 0 {
+		return errors.New("MaxZipSize can't be negative")
+	}
+
+	if a.SortBy != "" && !IsValidSortBy(a.SortBy) {
+		return fmt.Errorf("Unknown SortBy '%s', valid options are name, name-desc, modified, modified-desc,"+
+			" taken, taken-desc", a.SortBy)
+	}
+
 	if a.InIndex && a.HasOwnAuth() {
 		return errors.New("An album that requires authentication can't be shown in the index. If you need authentication please add it to the site.")
 	}
@@ -124,7 +264,7 @@ func (a *Album) Canonicalize() {
 }
 
 func (a *Album) HasOwnAuth() bool {
-	return a.AuthUser != "" && a.AuthPass != ""
+	return (a.AuthUser != "" && a.AuthPass != "") || len(a.authUsers) > 0 || a.AuthMode == AUTH_MODE_OIDC
 }
 
 // An album inherits it's sites auth settings if the album config doesn't override them. If both the site and album have
@@ -133,8 +273,10 @@ func (a *Album) HasAuth() bool {
 	return a.site.HasAuth() || a.HasOwnAuth()
 }
 
+// Albums with auth of their own never fall back to the site's credentials, so
+// e.g. the site's password can't get anyone past an album's OIDC login.
 func (a *Album) GetAuthUser() string {
-	if a.AuthUser != "" {
+	if a.HasOwnAuth() {
 		return a.AuthUser
 	} else {
 		return a.site.AuthUser
@@ -142,13 +284,28 @@ func (a *Album) GetAuthUser() string {
 }
 
 func (a *Album) GetAuthPass() string {
-	if a.AuthPass != "" {
+	if a.HasOwnAuth() {
 		return a.AuthPass
 	} else {
 		return a.site.AuthPass
 	}
 }
 
+func (a *Album) GetAuthMode() string {
+	if a.AuthMode != "" {
+		return a.AuthMode
+	}
+	return a.site.GetAuthMode()
+}
+
+// the album's own users file replaces the site's, like its AuthUser and AuthPass do
+func (a *Album) GetAuthUsers() map[string]string {
+	if a.HasOwnAuth() {
+		return a.authUsers
+	}
+	return a.site.GetAuthUsers()
+}
+
 func (a *Album) GetCanonicalUrl() *url.URL {
 	u := a.site.GetCanonicalUrl()
 	u.Path = a.Path
@@ -205,24 +362,20 @@ func (a *Album) GetThumbnailPhotosForTemplate() []Renderable {
 	return albumOrdering.Thumbnails
 }
 
-//lowest level, gets the list of objects in the bucket and prefix that
+//lowest level, gets the list of objects in the storage prefix that
 //corresponds to the album it is acting on, it's an object with multiple
 //fields.
-func (a *Album) GetAllObjects() ([]*s3.Object, error) {
-	svc, err := a.site.GetS3Service()
+func (a *Album) GetAllObjects() ([]*StorageObject, error) {
+	maxKeys := a.site.GetMaxAlbumKeys()
+	objects, truncated, err := a.site.GetStorage().ListObjects(a.BucketPrefix, maxKeys)
 	if err != nil {
 		return nil, err
 	}
-
-	objects, err := svc.ListObjects(&s3.ListObjectsInput{
-		Bucket:    aws.String(a.site.BucketName),
-		Prefix:    aws.String(a.BucketPrefix),
-		Delimiter: aws.String("/"),
-	})
-	if err != nil {
-		return nil, err
+	if truncated {
+		log.Printf("Album %s has more than %d objects under prefix '%s', ignoring the rest\n",
+			a.Path, maxKeys, a.BucketPrefix)
 	}
-	return objects.Contents, nil
+	return objects, nil
 }
 
 //wrapper around the lowest level method to extract out the fields of relevance, namely
@@ -232,10 +385,13 @@ func (a *Album) GetAllObjectKeysFromBucket() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return objectKeys(objects), nil
+}
 
+func objectKeys(objects []*StorageObject) []string {
 	var imageKeys []string
 	for _, obj := range objects {
-		key := *obj.Key
+		key := obj.Key
 		if key[len(key)-1] != '/' {
 			//check for 'folder' name vs actual object - objects end without trailing /
 			imageKeys = append(imageKeys, key)
@@ -243,7 +399,7 @@ func (a *Album) GetAllObjectKeysFromBucket() ([]string, error) {
 	}
 
 	natsort.Strings(imageKeys)
-	return imageKeys, nil
+	return imageKeys
 }
 
 //highest level, acts on an album to return processed renderable imageurls, here we must also
@@ -256,33 +412,28 @@ func (a *Album) GetOrderedPhotos() (AlbumOrdering, error) {
 	//pick up our configuration, note that this may be all empties if there's an err in retrieval/parsing.
 	albumOrderingConfig, err := a.GetAlbumOrderingConfig()
 
-	if err != nil {
-		if aerr, ok := err.(awserr.RequestFailure); ok {
-			if aerr.StatusCode() != 404 {
-				//regular 404's add too much noise, we shouldn't say anything. Other errors should be displayed.
-				fmt.Printf("\nUnable to pick up album ordering for album %s from S3, Error: %s", a.Path, err.Error())
-			}
-		}
+	if err != nil && err != ErrObjectNotFound {
+		//regular 404's add too much noise, we shouldn't say anything. Other errors should be displayed.
+		fmt.Printf("\nUnable to pick up album ordering for album %s from storage, Error: %s", a.Path, err.Error())
 	}
 
 	// pick up the raw keys, ready for comparison to our configuration
 	imageKeys, err := a.GetAllObjectKeys()
 
 	if err != nil {
-		fmt.Printf("\nUnable to get object keys from S3 for album %s. Error: %s", a.Path, err.Error())
+		fmt.Printf("\nUnable to get object keys from storage for album %s. Error: %s", a.Path, err.Error())
 		//note albumOrdering would be empty, error checking matters!
 		return albumOrdering, err
 	}
 
 	var cleanImageKeys []string
-	//clean out the keys, we don't want the yaml interfering with the yaml :P
-	for _, v := range imageKeys {
-		if strings.HasSuffix(v, ORDERING_YAML_NAME) {
-			//for now, just do nothing, we simply want to avoid appending,
-			//when we agree on a list of valid formats, we can ditch this check.
-		} else {
-			cleanImageKeys = append(cleanImageKeys, v)
-		}
+	sortBy := a.GetSortBy(albumOrderingConfig)
+	if cached, ok := a.SortedKeyCache.Load().(*sortedKeys); ok && cached.sortBy == sortBy {
+		cleanImageKeys = cached.keys
+	} else {
+		// the ordering file changed how to sort since the last refresh
+		cleanImageKeys = photoKeys(imageKeys)
+		a.sortKeys(cleanImageKeys, sortBy, a.getCachedObjects())
 	}
 
 	//okay, now we're ready for processing and merging.
@@ -346,9 +497,16 @@ func (a *Album) GetOrderedPhotos() (AlbumOrdering, error) {
 	}
 
 	//the actual album ordering
-	mergedOrdering := mergeList(cleanImageKeys, albumOrderingConfig.Ordering, a.Path)
+	mergedOrdering := mergeList(cleanImageKeys, albumOrderingConfig.GetOrderingKeys(), a.Path)
+	orderingEntries := albumOrderingConfig.GetOrderingEntries()
 	for _, v := range mergedOrdering {
-		albumOrdering.Ordering = append(albumOrdering.Ordering, a.site.GetPhotoForKey(v))
+		entry := orderingEntries[strings.TrimLeft(v, "/")]
+		albumOrdering.Ordering = append(albumOrdering.Ordering, &CaptionedPhoto{
+			Renderable: a.site.GetPhotoForKey(v),
+			Title:      entry.Title,
+			Caption:    entry.Caption,
+			Alt:        entry.Alt,
+		})
 	}
 
 	return albumOrdering, nil
@@ -360,30 +518,19 @@ func (a *Album) GetOrderedPhotos() (AlbumOrdering, error) {
 func (a *Album) GetAllObjectKeys() ([]string, error) {
 	c := make(chan *GetFromKeyCacheResult)
 	go func() {
-		var keys []string
-		var err error
-
 		if a.KeyCache.Load() != nil {
 			c <- &GetFromKeyCacheResult{a.KeyCache.Load().([]string), nil}
 
 			a.KeyCacheUpdateMutex.Lock()
 			if a.NeedsKeyCacheUpdate() {
-				keys, err = a.GetAllObjectKeysFromBucket()
-				if err == nil {
-					a.KeyCache.Store(keys)
-					a.LastKeyCacheUpdate = time.Now()
-				}
+				a.refreshKeyCache()
 			}
 
 			a.KeyCacheUpdateMutex.Unlock()
 		} else {
 			a.KeyCacheUpdateMutex.Lock()
 
-			keys, err = a.GetAllObjectKeysFromBucket()
-			if err == nil {
-				a.KeyCache.Store(keys)
-				a.LastKeyCacheUpdate = time.Now()
-			}
+			keys, err := a.refreshKeyCache()
 			c <- &GetFromKeyCacheResult{keys, err}
 
 			a.KeyCacheUpdateMutex.Unlock()
@@ -398,49 +545,201 @@ func (a *Album) GetAllObjectKeys() ([]string, error) {
 	}
 }
 
-//retrieves the actual album ordering from s3, it expects a file as hard-coded in
+//fetches the keys from storage and stores them in the key cache if that worked,
+//callers must hold KeyCacheUpdateMutex.
+func (a *Album) refreshKeyCache() ([]string, error) {
+	objects, err := a.GetAllObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	if a.SubAlbums {
+		if subAlbumErr := a.refreshSubAlbums(); subAlbumErr != nil {
+			fmt.Printf("\nUnable to get sub albums from storage for album %s. Error: %s", a.Path, subAlbumErr.Error())
+		}
+	}
+
+	objectsByKey := make(map[string]*StorageObject)
+	for _, obj := range objects {
+		objectsByKey[obj.Key] = obj
+	}
+	a.pruneExifCache(objectsByKey)
+
+	keys := objectKeys(objects)
+
+	// sorting can mean reading the EXIF data of new photos, better here than
+	// on every request
+	albumOrderingConfig, _ := a.GetAlbumOrderingConfig()
+	sorted := &sortedKeys{a.GetSortBy(albumOrderingConfig), photoKeys(keys)}
+	a.sortKeys(sorted.keys, sorted.sortBy, objectsByKey)
+
+	a.ObjectCache.Store(objectsByKey)
+	a.KeyCache.Store(keys)
+	a.SortedKeyCache.Store(sorted)
+	a.LastKeyCacheUpdate = time.Now()
+	return keys, nil
+}
+
+func (a *Album) getCachedObjects() map[string]*StorageObject {
+	if objects := a.ObjectCache.Load(); objects != nil {
+		return objects.(map[string]*StorageObject)
+	}
+	return nil
+}
+
+//builds a child album for every folder under our prefix. Children we already had
+//are kept as they are, so that their own caches survive.
+func (a *Album) refreshSubAlbums() error {
+	prefixes, err := a.site.GetStorage().ListPrefixes(a.BucketPrefix)
+	if err != nil {
+		return err
+	}
+	natsort.Strings(prefixes)
+
+	existing := make(map[string]*Album)
+	for _, subAlbum := range a.getCachedSubAlbums() {
+		existing[subAlbum.BucketPrefix] = subAlbum
+	}
+
+	subAlbums := make([]*Album, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if subAlbum, ok := existing[prefix]; ok {
+			subAlbums = append(subAlbums, subAlbum)
+		} else {
+			subAlbums = append(subAlbums, a.newSubAlbum(prefix))
+		}
+	}
+
+	a.SubAlbumCache.Store(subAlbums)
+	return nil
+}
+
+//child albums inherit everything from their parent, their titles get the
+//folder name appended.
+func (a *Album) newSubAlbum(bucketPrefix string) *Album {
+	name := strings.TrimSuffix(strings.TrimPrefix(bucketPrefix, a.BucketPrefix), "/")
+	return &Album{
+		site:               a.site,
+		Path:               a.Path + name + "/",
+		BucketPrefix:       bucketPrefix,
+		AuthUser:           a.AuthUser,
+		AuthPass:           a.AuthPass,
+		AuthUsersFile:      a.AuthUsersFile,
+		authUsers:          a.authUsers,
+		AuthMode:           a.AuthMode,
+		OidcIssuer:         a.OidcIssuer,
+		OidcClientId:       a.OidcClientId,
+		OidcClientSecret:   a.OidcClientSecret,
+		OidcAllowedEmails:  a.OidcAllowedEmails,
+		OidcAllowedDomains: a.OidcAllowedDomains,
+		ShareSecret:        a.ShareSecret,
+		MetaTitle:          a.MetaTitle + " - " + name,
+		AlbumTitle:         a.AlbumTitle + " - " + name,
+		InIndex:            false,
+		SubAlbums:          true,
+		SortBy:             a.SortBy,
+		AllowZipDownload:   a.AllowZipDownload,
+		MaxZipSize:         a.MaxZipSize,
+		AllowOriginals:     a.AllowOriginals,
+		KeyCacheTTL:        a.KeyCacheTTL,
+		OrderingCacheTTL:   a.OrderingCacheTTL,
+		NegativeCacheTTL:   a.NegativeCacheTTL,
+	}
+}
+
+func (a *Album) getCachedSubAlbums() []*Album {
+	if subAlbums := a.SubAlbumCache.Load(); subAlbums != nil {
+		return subAlbums.([]*Album)
+	}
+	return nil
+}
+
+//the child albums of this album, empty unless SubAlbums is turned on.
+func (a *Album) GetSubAlbums() []*Album {
+	if !a.SubAlbums {
+		return nil
+	}
+
+	// sub albums are refreshed along with the keys
+	a.GetAllObjectKeys()
+	return a.getCachedSubAlbums()
+}
+
+//looks for the album served at path among our children, and their children.
+func (a *Album) GetSubAlbumForPath(path string) *Album {
+	if !a.SubAlbums || !strings.HasPrefix(path, a.Path) {
+		return nil
+	}
+
+	for _, subAlbum := range a.GetSubAlbums() {
+		if subAlbum.Path == path {
+			return subAlbum
+		}
+		if found := subAlbum.GetSubAlbumForPath(path); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+//looks for the album holding the keys under prefix in this album's tree. If
+//there's no such album (yet), we return the closest album we found and false.
+func (a *Album) GetNearestAlbumForPrefix(prefix string) (*Album, bool) {
+	if a.BucketPrefix == prefix {
+		return a, true
+	}
+
+	if a.SubAlbums {
+		for _, subAlbum := range a.GetSubAlbums() {
+			if strings.HasPrefix(prefix, subAlbum.BucketPrefix) {
+				return subAlbum.GetNearestAlbumForPrefix(prefix)
+			}
+		}
+	}
+	return a, false
+}
+
+//retrieves the actual album ordering from storage, it expects a file as hard-coded in
 // the constant ORDERING_YAML_NAME
 // we do a bit of preprocessing in order to take images from relative to a bucket in
 // to being absolute in the bucket (in that, in order to compare keys, we have bucket-name/image.jpg
 // instead of just image.jpg in the orderings/definitions. Since the config is per-bucket, we'll do that at
 // the lowest level in order to avoid confusion/difficulty later. (i.e: consistent from inception at the
 // cost of hiding a bit of reality)
-func (a *Album) GetAlbumOrderingConfigFromS3AndPreprocess() (AlbumOrderingConfig, error) {
+func (a *Album) GetAlbumOrderingConfigFromStorageAndPreprocess() (AlbumOrderingConfig, error) {
 	var albumOrdering AlbumOrderingConfig
-	svc, err := a.site.GetS3Service()
-	if err != nil {
-		return albumOrdering, err
-	}
 
 	orderingYAMLKey := strings.Join([]string{a.BucketPrefix, ORDERING_YAML_NAME}, "")
-	yaml_object, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(a.site.BucketName),
-		Key:    aws.String(orderingYAMLKey),
-	})
+	yaml_object, err := a.site.GetStorage().GetObject(orderingYAMLKey)
 
 	if err != nil {
-		if aerr, ok := err.(awserr.RequestFailure); ok {
-			if aerr.StatusCode() == 404 {
-				albumOrdering.negativeCacheThis = true
-			}
+		if err == ErrObjectNotFound {
+			albumOrdering.negativeCacheThis = true
 		}
 		//basically, we only want to negatively cache 404's, so we can mark this as such.
 		//should be retried later, but exception handling is up to the caller.
 		return albumOrdering, err
 	}
+	defer yaml_object.Close()
 
 	//extract the contents from what we read so we can then parse the yaml
-	data_bytes, err := ioutil.ReadAll(yaml_object.Body)
-	//data_string := string(data_bytes)
+	data_bytes, err := ioutil.ReadAll(yaml_object)
+	if err != nil {
+		return albumOrdering, err
+	}
 	err = yaml.Unmarshal(data_bytes, &albumOrdering)
 
 	if err != nil {
 		//we were unable to read what the yaml was, it's likely malformed, and that may not change
 		//anytime soon, so we negatively cache it, the caller should be aware
 		//that it's going to be a bad result though, so raise the error
-		fmt.Printf("\nCould not parse yaml for album %s, it's likely malformed. error: %s", a.Path, err)
 		albumOrdering.negativeCacheThis = true
-		return albumOrdering, err
+		return albumOrdering, fmt.Errorf("Could not parse yaml, it's likely malformed. error: %s", err)
+	}
+
+	if albumOrdering.Sort != "" && !IsValidSortBy(albumOrdering.Sort) {
+		fmt.Printf("\nIgnoring unknown sort '%s' in ordering file of album %s", albumOrdering.Sort, a.Path)
+		albumOrdering.Sort = ""
 	}
 
 	//we want to prepend the album path to every supported key, this is simply for later consistency.
@@ -467,18 +766,154 @@ func (a *Album) GetAlbumOrderingConfigFromS3AndPreprocess() (AlbumOrderingConfig
 	if len(albumOrdering.Ordering) > 0 {
 		for index, v := range albumOrdering.Ordering {
 			parsedAlbumPrefix, _ := url.Parse(a.BucketPrefix)
-			parsedCoverKey, _ := url.Parse(v)
+			parsedCoverKey, _ := url.Parse(v.Key)
 
 			fullPath := parsedAlbumPrefix.ResolveReference(parsedCoverKey).String()
-			albumOrdering.Ordering[index] = strings.TrimLeft(fullPath, "/")
+			albumOrdering.Ordering[index].Key = strings.TrimLeft(fullPath, "/")
 		}
 	}
 
 	return albumOrdering, nil
 }
 
-//note that this also caches negative values, i.e: adding a ordering file may take an hour
-//to be rechecked.
+//reads the album.yaml in the album's prefix, like the ordering config, a missing or
+//malformed file is marked to be negatively cached.
+func (a *Album) GetAlbumMetadataFromStorage() (AlbumMetadata, error) {
+	var albumMetadata AlbumMetadata
+
+	yaml_object, err := a.site.GetStorage().GetObject(a.BucketPrefix + ALBUM_YAML_NAME)
+	if err != nil {
+		if err == ErrObjectNotFound {
+			albumMetadata.negativeCacheThis = true
+		}
+		return albumMetadata, err
+	}
+	defer yaml_object.Close()
+
+	data_bytes, err := ioutil.ReadAll(yaml_object)
+	if err != nil {
+		return albumMetadata, err
+	}
+
+	if err := yaml.Unmarshal(data_bytes, &albumMetadata); err != nil {
+		albumMetadata = AlbumMetadata{negativeCacheThis: true}
+		return albumMetadata, fmt.Errorf("Could not parse yaml, it's likely malformed. error: %s", err)
+	}
+	return albumMetadata, nil
+}
+
+//cached the same way, and for as long as, the ordering config.
+func (a *Album) GetAlbumMetadata() (AlbumMetadata, error) {
+	c := make(chan *GetFromMetadataCacheResult)
+	go func() {
+		if a.MetadataCache.Load() != nil {
+			c <- &GetFromMetadataCacheResult{a.MetadataCache.Load().(AlbumMetadata), nil}
+
+			a.AlbumMetadataUpdateMutex.Lock()
+			if a.NeedsMetadataCacheUpdate() {
+				a.refreshMetadataCache()
+			}
+			a.AlbumMetadataUpdateMutex.Unlock()
+		} else {
+			a.AlbumMetadataUpdateMutex.Lock()
+
+			albumMetadata, err := a.refreshMetadataCache()
+			c <- &GetFromMetadataCacheResult{albumMetadata, err}
+
+			a.AlbumMetadataUpdateMutex.Unlock()
+		}
+	}()
+
+	var albumMetadata AlbumMetadata
+	result := <-c
+	if result.err != nil {
+		return albumMetadata, result.err
+	} else {
+		return result.albumMetadata, result.err
+	}
+}
+
+//callers must hold AlbumMetadataUpdateMutex.
+func (a *Album) refreshMetadataCache() (AlbumMetadata, error) {
+	albumMetadata, err := a.GetAlbumMetadataFromStorage()
+	if err == nil || albumMetadata.negativeCacheThis {
+		a.MetadataCache.Store(albumMetadata)
+		a.LastAlbumMetadataCacheUpdate = time.Now()
+	}
+	if err != nil && err != ErrObjectNotFound {
+		fmt.Printf("\nUnable to pick up album metadata for album %s from storage, Error: %s", a.Path, err.Error())
+	}
+	return albumMetadata, err
+}
+
+//metadata for templates, empty if there isn't any
+func (a *Album) getAlbumMetadataForTemplate() AlbumMetadata {
+	albumMetadata, _ := a.GetAlbumMetadata()
+	return albumMetadata
+}
+
+func (a *Album) GetAlbumTitle() string {
+	if title := a.getAlbumMetadataForTemplate().Title; title != "" {
+		return title
+	}
+	return a.AlbumTitle
+}
+
+//falls back to the album title if neither album.yaml nor the INI file set one
+func (a *Album) GetMetaTitle() string {
+	if metaTitle := a.getAlbumMetadataForTemplate().MetaTitle; metaTitle != "" {
+		return metaTitle
+	}
+	if a.MetaTitle != "" {
+		return a.MetaTitle
+	}
+	return a.GetAlbumTitle()
+}
+
+//the description rendered to HTML. Raw HTML in the markdown is dropped and
+//only safe links are kept, as it comes from whoever can write to the bucket.
+func (a *Album) GetDescription() template.HTML {
+	description := a.getAlbumMetadataForTemplate().Description
+	if description == "" {
+		return ""
+	}
+
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.SkipHTML | blackfriday.Safelink | blackfriday.NofollowLinks | blackfriday.NoreferrerLinks,
+	})
+	return template.HTML(blackfriday.Run([]byte(description), blackfriday.WithRenderer(renderer)))
+}
+
+//e.g: '12 March 2019', or '12 March 2019 - 15 March 2019'
+func (a *Album) GetDateRange() string {
+	albumMetadata := a.getAlbumMetadataForTemplate()
+	start, end := albumMetadata.StartDate, albumMetadata.EndDate
+	if start.IsZero() {
+		start, end = end, time.Time{}
+	}
+	if start.IsZero() {
+		return ""
+	}
+
+	dateRange := start.Format(ALBUM_DATE_FORMAT)
+	if !end.IsZero() && end.Format(ALBUM_DATE_FORMAT) != dateRange {
+		dateRange += " - " + end.Format(ALBUM_DATE_FORMAT)
+	}
+	return dateRange
+}
+
+func (a *Album) GetLocation() string {
+	return a.getAlbumMetadataForTemplate().Location
+}
+
+//the INI file decides if an album can be in the index, album.yaml can only
+//hide it.
+func (a *Album) IsInIndex() bool {
+	return a.InIndex && !a.getAlbumMetadataForTemplate().Hidden
+}
+
+//note that this also caches negative values, i.e: adding a ordering file may take
+//NegativeCacheTTL (an hour by default) to be rechecked.
 func (a *Album) GetAlbumOrderingConfig() (AlbumOrderingConfig, error) {
 	c := make(chan *GetFromOrderingConfigCacheResult)
 	go func() {
@@ -487,29 +922,13 @@ func (a *Album) GetAlbumOrderingConfig() (AlbumOrderingConfig, error) {
 
 			a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
 			if a.NeedsOrderingCacheUpdate() {
-
-				albumOrdering, err := a.GetAlbumOrderingConfigFromS3AndPreprocess()
-				if err == nil || albumOrdering.negativeCacheThis {
-					// whether the item is valid or we should be negatively
-					// caching this result (probs err!=nil, but the value
-					// should be there and a valid boolean.
-					a.OrderingCache.Store(albumOrdering)
-					a.LastAlbumOrderingConfigCacheUpdate = time.Now()
-				}
-
+				a.refreshOrderingCache()
 			}
 			a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
 		} else {
 			a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
-			albumOrdering, err := a.GetAlbumOrderingConfigFromS3AndPreprocess()
-			if err == nil || albumOrdering.negativeCacheThis {
-				// whether the item is valid or we should be negatively
-				// caching this result (probs err!=nil, but the value
-				// should be there and a valid boolean.
-				a.OrderingCache.Store(albumOrdering)
-				a.LastAlbumOrderingConfigCacheUpdate = time.Now()
-			}
 
+			albumOrdering, err := a.refreshOrderingCache()
 			c <- &GetFromOrderingConfigCacheResult{albumOrdering, err}
 
 			a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
@@ -526,6 +945,137 @@ func (a *Album) GetAlbumOrderingConfig() (AlbumOrderingConfig, error) {
 	}
 }
 
+//fetches the ordering config from storage and caches it, callers must hold
+//AlbumAlbumOrderingConfigUpdateMutex.
+func (a *Album) refreshOrderingCache() (AlbumOrderingConfig, error) {
+	albumOrdering, err := a.GetAlbumOrderingConfigFromStorageAndPreprocess()
+	if err == nil || albumOrdering.negativeCacheThis {
+		// whether the item is valid or we should be negatively
+		// caching this result (probs err!=nil, but the value
+		// should be there and a valid boolean.
+		a.OrderingCache.Store(albumOrdering)
+		a.LastAlbumOrderingConfigCacheUpdate = time.Now()
+	}
+	return albumOrdering, err
+}
+
+// Throws away whatever is cached for this album and refetches it from storage.
+// If the refetch fails the caches are left expired, so the next request retries.
+func (a *Album) PurgeCaches() error {
+	keyErr := a.PurgeKeyCache()
+	orderingErr := a.PurgeOrderingCache()
+	metadataErr := a.PurgeMetadataCache()
+
+	if keyErr != nil {
+		return keyErr
+	}
+	if orderingErr != nil {
+		return orderingErr
+	}
+	return metadataErr
+}
+
+func (a *Album) PurgeKeyCache() error {
+	a.KeyCacheUpdateMutex.Lock()
+	defer a.KeyCacheUpdateMutex.Unlock()
+
+	a.LastKeyCacheUpdate = time.Time{}
+	_, err := a.refreshKeyCache()
+	return err
+}
+
+func (a *Album) PurgeOrderingCache() error {
+	a.AlbumAlbumOrderingConfigUpdateMutex.Lock()
+	defer a.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
+
+	a.LastAlbumOrderingConfigCacheUpdate = time.Time{}
+	if _, err := a.refreshOrderingCache(); err != nil && err != ErrObjectNotFound {
+		return err
+	}
+	return nil
+}
+
+func (a *Album) PurgeMetadataCache() error {
+	a.AlbumMetadataUpdateMutex.Lock()
+	defer a.AlbumMetadataUpdateMutex.Unlock()
+
+	a.LastAlbumMetadataCacheUpdate = time.Time{}
+	if _, err := a.refreshMetadataCache(); err != nil && err != ErrObjectNotFound {
+		return err
+	}
+	return nil
+}
+
+func (a *Album) InheritCachesFrom(old *Album) {
+	old.KeyCacheUpdateMutex.Lock()
+	if keys := old.KeyCache.Load(); keys != nil {
+		a.KeyCache.Store(keys)
+		a.LastKeyCacheUpdate = old.LastKeyCacheUpdate
+	}
+	if objects := old.ObjectCache.Load(); objects != nil {
+		a.ObjectCache.Store(objects)
+	}
+	if sorted := old.SortedKeyCache.Load(); sorted != nil {
+		a.SortedKeyCache.Store(sorted)
+	}
+	oldSubAlbums := old.getCachedSubAlbums()
+	old.KeyCacheUpdateMutex.Unlock()
+
+	// the old children belong to the old site, so we rebuild them from our own
+	// settings and only carry their caches over.
+	if a.SubAlbums && oldSubAlbums != nil {
+		subAlbums := make([]*Album, 0, len(oldSubAlbums))
+		for _, oldSubAlbum := range oldSubAlbums {
+			subAlbum := a.newSubAlbum(oldSubAlbum.BucketPrefix)
+			subAlbum.InheritCachesFrom(oldSubAlbum)
+			subAlbums = append(subAlbums, subAlbum)
+		}
+		a.SubAlbumCache.Store(subAlbums)
+	}
+
+	old.AlbumAlbumOrderingConfigUpdateMutex.Lock()
+	if albumOrderingConfig := old.OrderingCache.Load(); albumOrderingConfig != nil {
+		a.OrderingCache.Store(albumOrderingConfig)
+		a.LastAlbumOrderingConfigCacheUpdate = old.LastAlbumOrderingConfigCacheUpdate
+	}
+	old.AlbumAlbumOrderingConfigUpdateMutex.Unlock()
+
+	old.AlbumMetadataUpdateMutex.Lock()
+	if albumMetadata := old.MetadataCache.Load(); albumMetadata != nil {
+		a.MetadataCache.Store(albumMetadata)
+		a.LastAlbumMetadataCacheUpdate = old.LastAlbumMetadataCacheUpdate
+	}
+	old.AlbumMetadataUpdateMutex.Unlock()
+
+	old.ExifCacheMutex.Lock()
+	a.ExifCache = make(map[string]*exifCacheEntry, len(old.ExifCache))
+	for key, entry := range old.ExifCache {
+		a.ExifCache[key] = entry
+	}
+	old.ExifCacheMutex.Unlock()
+}
+
+//the position of the photo with this slug in the ordering, -1 if it isn't there
+func (o AlbumOrdering) GetIndexForSlug(slug string) int {
+	for i, v := range o.Ordering {
+		if strings.TrimLeft(v.Slug(), "/") == strings.TrimLeft(slug, "/") {
+			return i
+		}
+	}
+	return -1
+}
+
+//the photo in the album with this slug, nil if there isn't one
+func (a *Album) GetPhotoForSlug(slug string) *CaptionedPhoto {
+	albumOrdering, err := a.GetOrderedPhotos()
+	if err == nil {
+		if i := albumOrdering.GetIndexForSlug(slug); i != -1 {
+			return albumOrdering.Ordering[i]
+		}
+	}
+	return nil
+}
+
 func (a *Album) ImageExists(slug string) bool {
 	albumOrdering, err := a.GetOrderedPhotos()
 	if err == nil {
@@ -539,10 +1089,44 @@ func (a *Album) ImageExists(slug string) bool {
 	return false
 }
 
+func (a *Album) GetKeyCacheTTL() time.Duration {
+	if a.KeyCacheTTL > 0 {
+		return a.KeyCacheTTL
+	}
+	return a.site.GetKeyCacheTTL()
+}
+
+func (a *Album) GetOrderingCacheTTL() time.Duration {
+	if a.OrderingCacheTTL > 0 {
+		return a.OrderingCacheTTL
+	}
+	return a.site.GetOrderingCacheTTL()
+}
+
+func (a *Album) GetNegativeCacheTTL() time.Duration {
+	if a.NegativeCacheTTL > 0 {
+		return a.NegativeCacheTTL
+	}
+	return a.site.GetNegativeCacheTTL()
+}
+
+func (a *Album) NeedsMetadataCacheUpdate() bool {
+	ttl := a.GetOrderingCacheTTL()
+	if cached := a.MetadataCache.Load(); cached != nil && cached.(AlbumMetadata).negativeCacheThis {
+		ttl = a.GetNegativeCacheTTL()
+	}
+	return time.Now().Sub(a.LastAlbumMetadataCacheUpdate) > ttl
+}
+
 func (a *Album) NeedsKeyCacheUpdate() bool {
-	return time.Now().Sub(a.LastKeyCacheUpdate) > CACHE_INTERVAL
+	return time.Now().Sub(a.LastKeyCacheUpdate) > a.GetKeyCacheTTL()
 }
 
+//a missing or broken ordering file is cached for the negative TTL instead
 func (a *Album) NeedsOrderingCacheUpdate() bool {
-	return time.Now().Sub(a.LastAlbumOrderingConfigCacheUpdate) > CACHE_INTERVAL
+	ttl := a.GetOrderingCacheTTL()
+	if cached := a.OrderingCache.Load(); cached != nil && cached.(AlbumOrderingConfig).negativeCacheThis {
+		ttl = a.GetNegativeCacheTTL()
+	}
+	return time.Now().Sub(a.LastAlbumOrderingConfigCacheUpdate) > ttl
 }
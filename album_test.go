@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetOrderedPhotosCaptions(t *testing.T) {
+	site := loadTestSite(t, "[Trips]\nPath = /trips/\nBucketPrefix = trips/\n")
+	for _, name := range []string{"beach.jpg", "sunset.jpg", "boat.jpg"} {
+		writeTestPhoto(t, site, "trips/"+name)
+	}
+	// keys can be relative to the album or absolute
+	ordering := "ordering:\n" +
+		"  - key: sunset.jpg\n    title: Sunset\n    caption: Over the sea\n" +
+		"  - key: /trips/boat.jpg\n    title: Boat\n" +
+		"  - missing.jpg\n"
+	if err := ioutil.WriteFile(filepath.Join(site.StorageRoot, "trips", ORDERING_YAML_NAME), []byte(ordering), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	album, err := site.GetAlbumForPath("/trips/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photos, err := album.GetOrderedPhotos()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(photos.Ordering) != 3 {
+		t.Fatalf("Expected 3 photos, got %d", len(photos.Ordering))
+	}
+	expected := []struct{ title, caption string }{{"Sunset", "Over the sea"}, {"Boat", ""}, {"", ""}}
+	for i, photo := range photos.Ordering {
+		if photo.Title != expected[i].title || photo.Caption != expected[i].caption {
+			t.Errorf("Expected photo %d to have title %q and caption %q, got %q and %q",
+				i, expected[i].title, expected[i].caption, photo.Title, photo.Caption)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A read only JSON view of the site, for apps built on top of 50mm:
+//
+//	/_api/albums                  the albums on the site index
+//	/_api/albums/<path>           an album and its photos
+//	/_api/albums/<path>/<slug>    a photo
+//
+// The same auth rules apply as for the HTML pages.
+const API_ROUTE = "/_api/"
+const API_ALBUMS_ROUTE = API_ROUTE + "albums"
+
+const API_DATE_FORMAT = "2006-01-02"
+
+type ApiError struct {
+	Error string `json:"error"`
+}
+
+type ApiImage struct {
+	Width int    `json:"width"`
+	Url   string `json:"url"`
+}
+
+type ApiPhoto struct {
+	Slug        string      `json:"slug"`
+	Url         string      `json:"url"` // of the photo's page
+	Title       string      `json:"title,omitempty"`
+	Caption     string      `json:"caption,omitempty"`
+	Alt         string      `json:"alt,omitempty"`
+	Images      []*ApiImage `json:"images"` // one per SrcSetWidths
+	OriginalUrl string      `json:"original_url,omitempty"`
+}
+
+type ApiPhotoDetails struct {
+	*ApiPhoto
+	Album     string     `json:"album"` // the album's API URL
+	Position  int        `json:"position"`
+	NumPhotos int        `json:"num_photos"`
+	Previous  string     `json:"previous,omitempty"` // slug
+	Next      string     `json:"next,omitempty"`     // slug
+	Exif      *PhotoExif `json:"exif,omitempty"`
+}
+
+type ApiAlbum struct {
+	Path           string      `json:"path"`
+	Url            string      `json:"url"`
+	ApiUrl         string      `json:"api_url"`
+	Title          string      `json:"title"`
+	Description    string      `json:"description,omitempty"` // HTML
+	StartDate      string      `json:"start_date,omitempty"`
+	EndDate        string      `json:"end_date,omitempty"`
+	Location       string      `json:"location,omitempty"`
+	Cover          *ApiPhoto   `json:"cover,omitempty"`
+	Thumbnails     []*ApiPhoto `json:"thumbnails,omitempty"`
+	ZipDownloadUrl string      `json:"zip_download_url,omitempty"`
+
+	// only filled in for a single album
+	SubAlbums []*ApiAlbum `json:"sub_albums,omitempty"`
+	Photos    []*ApiPhoto `json:"photos,omitempty"`
+}
+
+func handleApi(site *Site, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeApiResponse(w, http.StatusMethodNotAllowed, &ApiError{"Method not allowed"})
+		return
+	}
+
+	path := r.URL.Path
+	if path == API_ALBUMS_ROUTE {
+		handleApiAlbums(site, w, r)
+		return
+	}
+	if !strings.HasPrefix(path, API_ALBUMS_ROUTE+"/") {
+		writeApiResponse(w, http.StatusNotFound, &ApiError{"Not found"})
+		return
+	}
+
+	albumPath := strings.TrimPrefix(path, API_ALBUMS_ROUTE)
+	if album, err := site.GetAlbumForPath(albumPath); err == nil {
+		handleApiAlbum(album, w, r)
+		return
+	}
+
+	// not an album, see if it's an album + photo
+	i := strings.LastIndex(albumPath, "/") + 1
+	album, err := site.GetAlbumForPath(albumPath[:i])
+	if err != nil {
+		writeApiResponse(w, http.StatusNotFound, &ApiError{err.Error()})
+		return
+	}
+	handleApiPhoto(album, albumPath[i:], w, r)
+}
+
+func handleApiAlbums(site *Site, w http.ResponseWriter, r *http.Request) {
+	if !site.HasAlbumIndex {
+		writeApiResponse(w, http.StatusNotFound, &ApiError{"This site doesn't list its albums"})
+		return
+	}
+	if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
+		return
+	}
+
+	albums := make([]*ApiAlbum, 0)
+	for _, album := range site.GetAlbumsForIndex() {
+		albums = append(albums, newApiAlbum(album))
+	}
+	writeApiResponse(w, http.StatusOK, albums)
+}
+
+func handleApiAlbum(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	albumOrdering, err := album.GetOrderedPhotos()
+	if err != nil {
+		writeApiResponse(w, http.StatusInternalServerError, &ApiError{err.Error()})
+		return
+	}
+
+	apiAlbum := newApiAlbum(album)
+	for _, subAlbum := range album.GetSubAlbums() {
+		apiAlbum.SubAlbums = append(apiAlbum.SubAlbums, newApiAlbum(subAlbum))
+	}
+	apiAlbum.Photos = make([]*ApiPhoto, 0, len(albumOrdering.Ordering))
+	for _, photo := range albumOrdering.Ordering {
+		apiAlbum.Photos = append(apiAlbum.Photos, newApiPhoto(album, photo))
+	}
+	writeApiResponse(w, http.StatusOK, apiAlbum)
+}
+
+func handleApiPhoto(album *Album, slug string, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	albumOrdering, err := album.GetOrderedPhotos()
+	if err != nil {
+		writeApiResponse(w, http.StatusInternalServerError, &ApiError{err.Error()})
+		return
+	}
+
+	i := albumOrdering.GetIndexForSlug(slug)
+	if i == -1 {
+		writeApiResponse(w, http.StatusNotFound, &ApiError{"Could not find photo '" + slug + "' in album " + album.Path})
+		return
+	}
+
+	details := &ApiPhotoDetails{
+		ApiPhoto:  newApiPhoto(album, albumOrdering.Ordering[i]),
+		Album:     album.getApiUrl(),
+		Position:  i + 1,
+		NumPhotos: len(albumOrdering.Ordering),
+	}
+	if i > 0 {
+		details.Previous = albumOrdering.Ordering[i-1].Slug()
+	}
+	if i < len(albumOrdering.Ordering)-1 {
+		details.Next = albumOrdering.Ordering[i+1].Slug()
+	}
+	if album.site.ShowExif {
+		details.Exif = album.GetExifForKey(album.BucketPrefix + slug)
+	}
+	writeApiResponse(w, http.StatusOK, details)
+}
+
+func (a *Album) getApiUrl() string {
+	u := a.site.GetCanonicalUrl()
+	u.Path = API_ALBUMS_ROUTE + a.Path
+	return u.String()
+}
+
+// everything about the album but its photos
+func newApiAlbum(album *Album) *ApiAlbum {
+	albumMetadata := album.getAlbumMetadataForTemplate()
+	apiAlbum := &ApiAlbum{
+		Path:           album.Path,
+		Url:            album.GetCanonicalUrl().String(),
+		ApiUrl:         album.getApiUrl(),
+		Title:          album.GetAlbumTitle(),
+		Description:    string(album.GetDescription()),
+		Location:       album.GetLocation(),
+		ZipDownloadUrl: album.GetZipDownloadUrl(),
+	}
+	if !albumMetadata.StartDate.IsZero() {
+		apiAlbum.StartDate = albumMetadata.StartDate.Format(API_DATE_FORMAT)
+	}
+	if !albumMetadata.EndDate.IsZero() {
+		apiAlbum.EndDate = albumMetadata.EndDate.Format(API_DATE_FORMAT)
+	}
+
+	if albumOrdering, err := album.GetOrderedPhotos(); err == nil {
+		if albumOrdering.Cover != nil && albumOrdering.Cover.Slug() != "" {
+			apiAlbum.Cover = newApiPhoto(album, &CaptionedPhoto{Renderable: albumOrdering.Cover})
+		}
+		for _, thumbnail := range albumOrdering.Thumbnails {
+			apiAlbum.Thumbnails = append(apiAlbum.Thumbnails, newApiPhoto(album, &CaptionedPhoto{Renderable: thumbnail}))
+		}
+	}
+	return apiAlbum
+}
+
+func newApiPhoto(album *Album, photo *CaptionedPhoto) *ApiPhoto {
+	apiPhoto := &ApiPhoto{
+		Slug:        photo.Slug(),
+		Url:         album.GetCanonicalUrl().String() + photo.Slug(),
+		Title:       photo.Title,
+		Caption:     photo.Caption,
+		Alt:         photo.GetAltText(),
+		OriginalUrl: album.GetOriginalUrl(photo.Slug()),
+	}
+	for _, width := range album.site.GetSrcSetWidths() {
+		apiPhoto.Images = append(apiPhoto.Images, &ApiImage{width, photo.GetPhotoForWidth(width)})
+	}
+	return apiPhoto
+}
+
+func writeApiResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Unable to write API response. Error: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthPass, and the passwords in an AuthUsersFile, can be bcrypt hashes
+// ('$2a$', '$2b$' or '$2y$', e.g. from 'htpasswd -B') or argon2 hashes in the
+// PHC format ('$argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>'). AuthPass can
+// also be a plaintext password, for older configs. bcrypt hashes are always 60
+// characters long, anything else is taken as plaintext, even if it starts
+// like a hash.
+var BCRYPT_HASH_PREFIXES = []string{"$2a$", "$2b$", "$2y$"}
+
+const BCRYPT_HASH_LENGTH = 60
+const ARGON2ID_HASH_PREFIX = "$argon2id$"
+const ARGON2I_HASH_PREFIX = "$argon2i$"
+
+// used by 50mm hash-password
+const ARGON2_TIME = 3
+const ARGON2_MEMORY = 64 * 1024 // in KB
+const ARGON2_THREADS = 4
+const ARGON2_SALT_LENGTH = 16
+const ARGON2_KEY_LENGTH = 32
+
+// argon2 hashes with parameters outside these are refused when the config is
+// loaded, they would take too long or too much memory to check
+const MAX_ARGON2_TIME = 16
+const MAX_ARGON2_MEMORY = 256 * 1024 // in KB
+const MAX_ARGON2_THREADS = 16
+
+// Anyone can make us check a password, and wrong passwords aren't remembered,
+// so only this many hashes are checked at a time.
+var passwordHashSemaphore = make(chan struct{}, runtime.NumCPU())
+
+// Hashes are slow on purpose, and browsers send basic auth credentials with
+// every request, so passwords that matched a hash are remembered for a while.
+// They're kept as HMACs with a key that only lives in memory.
+const MAX_VERIFIED_PASSWORDS = 1000
+
+var verifiedPasswords = make(map[string]bool)
+var verifiedPasswordsMutex sync.Mutex
+var verifiedPasswordsKey = newVerifiedPasswordsKey()
+
+func newVerifiedPasswordsKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func IsPasswordHash(stored string) bool {
+	return isBcryptHash(stored) ||
+		strings.HasPrefix(stored, ARGON2ID_HASH_PREFIX) ||
+		strings.HasPrefix(stored, ARGON2I_HASH_PREFIX)
+}
+
+func isBcryptHash(stored string) bool {
+	if len(stored) != BCRYPT_HASH_LENGTH {
+		return false
+	}
+	for _, prefix := range BCRYPT_HASH_PREFIXES {
+		if strings.HasPrefix(stored, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks password against a stored password, which is either a hash or the
+// password itself.
+func CheckPassword(password, stored string) bool {
+	if !IsPasswordHash(stored) {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(stored)) == 1
+	}
+
+	mac := hmac.New(sha256.New, verifiedPasswordsKey)
+	mac.Write([]byte(stored))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	cacheKey := string(mac.Sum(nil))
+
+	verifiedPasswordsMutex.Lock()
+	verified := verifiedPasswords[cacheKey]
+	verifiedPasswordsMutex.Unlock()
+	if verified {
+		return true
+	}
+
+	passwordHashSemaphore <- struct{}{}
+	var matches bool
+	if isBcryptHash(stored) {
+		matches = bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	} else {
+		matches = checkArgon2Password(password, stored)
+	}
+	<-passwordHashSemaphore
+
+	if matches {
+		verifiedPasswordsMutex.Lock()
+		if len(verifiedPasswords) >= MAX_VERIFIED_PASSWORDS {
+			verifiedPasswords = make(map[string]bool)
+		}
+		verifiedPasswords[cacheKey] = true
+		verifiedPasswordsMutex.Unlock()
+	}
+	return matches
+}
+
+// Checks that a bcrypt or argon2 hash can be checked against, so broken
+// hashes are found when the config is loaded rather than when someone logs
+// in. Plaintext passwords are always fine.
+func ValidatePasswordHash(stored string) error {
+	if isBcryptHash(stored) {
+		_, err := bcrypt.Cost([]byte(stored))
+		return err
+	}
+	if IsPasswordHash(stored) {
+		_, err := parseArgon2Hash(stored)
+		return err
+	}
+	return nil
+}
+
+type argon2Hash struct {
+	id      bool // argon2id, otherwise argon2i
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2Hash(stored string) (*argon2Hash, error) {
+	// "", "argon2id", "v=19", "m=65536,t=3,p=4", salt, hash
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("Not an argon2 hash with version %d", argon2.Version)
+	}
+
+	h := &argon2Hash{id: parts[1] == "argon2id"}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("Unable to read the argon2 parameters '%s'", parts[3])
+	}
+	if h.time == 0 || h.time > MAX_ARGON2_TIME || h.threads == 0 || h.threads > MAX_ARGON2_THREADS ||
+		h.memory == 0 || h.memory > MAX_ARGON2_MEMORY {
+		return nil, fmt.Errorf("The argon2 parameters '%s' need t between 1 and %d, p between 1 and %d and m between 1 and %d",
+			parts[3], MAX_ARGON2_TIME, MAX_ARGON2_THREADS, MAX_ARGON2_MEMORY)
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("Unable to decode the argon2 salt. Error: %s", err.Error())
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("Unable to decode the argon2 hash")
+	}
+	return h, nil
+}
+
+func checkArgon2Password(password, stored string) bool {
+	h, err := parseArgon2Hash(stored)
+	if err != nil {
+		return false
+	}
+
+	var key []byte
+	if h.id {
+		key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+func HashPasswordWithBcrypt(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func HashPasswordWithArgon2(password string) (string, error) {
+	salt := make([]byte, ARGON2_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, ARGON2_KEY_LENGTH)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", ARGON2ID_HASH_PREFIX, argon2.Version, ARGON2_MEMORY, ARGON2_TIME,
+		ARGON2_THREADS, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Reads an htpasswd style file, one 'user:hash' per line. Blank lines and
+// lines starting with a '#' are skipped. Only bcrypt and argon2 hashes are
+// accepted, not the MD5, SHA1 or crypt hashes htpasswd can also write.
+func LoadAuthUsersFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d isn't a 'user:hash' line", path, lineNumber)
+		}
+		user, hash := line[:i], line[i+1:]
+		if !IsPasswordHash(hash) {
+			return nil, fmt.Errorf("%s:%d the password of user '%s' isn't a bcrypt or argon2 hash", path, lineNumber, user)
+		}
+		if err := ValidatePasswordHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d the password hash of user '%s' can't be used. Error: %s", path, lineNumber, user, err.Error())
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s has no users", path)
+	}
+	return users, nil
+}
+
+// Whether the provider has a user and password, or users, to check against
+func hasCredentials(provider AuthCredentialsProvider) bool {
+	return (provider.GetAuthUser() != "" && provider.GetAuthPass() != "") || len(provider.GetAuthUsers()) > 0
+}
+
+// Whether user and password match the provider's AuthUser and AuthPass, or
+// one of the users in its AuthUsersFile.
+func checkCredentials(provider AuthCredentialsProvider, user, password string) bool {
+	if authUser, authPass := provider.GetAuthUser(), provider.GetAuthPass(); authUser != "" && authPass != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(authUser)) == 1 && CheckPassword(password, authPass) {
+		return true
+	}
+
+	if hash, ok := provider.GetAuthUsers()[user]; ok {
+		return CheckPassword(password, hash)
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"bitbucket.org/zombiezen/cardcpx/natsort"
+)
+
+var slugUnsafeChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Turns a folder name like 'Baku, Azerbaijan' in to 'baku-azerbaijan'
+func slugify(name string) string {
+	return strings.Trim(slugUnsafeChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// Every album on the site, configured ones first, followed by the ones
+// discovered from the bucket.
+func (s *Site) GetAllAlbums() []*Album {
+	autoAlbums := s.GetAutoAlbums()
+	if len(autoAlbums) == 0 {
+		return s.Albums
+	}
+
+	albums := make([]*Album, 0, len(s.Albums)+len(autoAlbums))
+	albums = append(albums, s.Albums...)
+	return append(albums, autoAlbums...)
+}
+
+// The albums discovered from the folders under AutoAlbumsPrefix. Like the album
+// key caches, we serve what we have and refresh it once it's older than
+// the site's KeyCacheTTL.
+func (s *Site) GetAutoAlbums() []*Album {
+	if !s.AutoAlbums {
+		return nil
+	}
+
+	if autoAlbums := s.AutoAlbumCache.Load(); autoAlbums != nil {
+		if s.NeedsAutoAlbumsUpdate() {
+			go func() {
+				s.AutoAlbumsUpdateMutex.Lock()
+				if s.NeedsAutoAlbumsUpdate() {
+					s.refreshAutoAlbums()
+				}
+				s.AutoAlbumsUpdateMutex.Unlock()
+			}()
+		}
+		return autoAlbums.([]*Album)
+	}
+
+	s.AutoAlbumsUpdateMutex.Lock()
+	defer s.AutoAlbumsUpdateMutex.Unlock()
+	if s.AutoAlbumCache.Load() == nil {
+		s.refreshAutoAlbums()
+	}
+	return s.getCachedAutoAlbums()
+}
+
+func (s *Site) NeedsAutoAlbumsUpdate() bool {
+	return time.Now().Sub(s.getLastAutoAlbumsUpdate()) > s.GetKeyCacheTTL()
+}
+
+func (s *Site) getLastAutoAlbumsUpdate() time.Time {
+	if lastUpdate := s.LastAutoAlbumsUpdate.Load(); lastUpdate != nil {
+		return lastUpdate.(time.Time)
+	}
+	return time.Time{}
+}
+
+func (s *Site) getCachedAutoAlbums() []*Album {
+	if autoAlbums := s.AutoAlbumCache.Load(); autoAlbums != nil {
+		return autoAlbums.([]*Album)
+	}
+	return nil
+}
+
+// Lists the folders under AutoAlbumsPrefix and makes an album out of every one
+// that isn't already configured in the INI file. Callers must hold
+// AutoAlbumsUpdateMutex.
+func (s *Site) refreshAutoAlbums() {
+	prefixes, err := s.GetStorage().ListPrefixes(s.AutoAlbumsPrefix)
+	if err != nil {
+		fmt.Printf("\nUnable to discover albums for site %s. Error: %s", s.Domain, err.Error())
+		if s.AutoAlbumCache.Load() == nil {
+			s.AutoAlbumCache.Store([]*Album{})
+		}
+		// try again on the next request rather than after a full TTL
+		return
+	}
+	natsort.Strings(prefixes)
+
+	configured := s.getConfiguredPrefixesAndPaths()
+
+	existing := make(map[string]*Album)
+	for _, album := range s.getCachedAutoAlbums() {
+		existing[album.BucketPrefix] = album
+	}
+
+	autoAlbums := make([]*Album, 0, len(prefixes))
+	prefixesByPath := make(map[string]string)
+	for _, prefix := range prefixes {
+		if configured[prefix] {
+			// explicit INI sections win
+			continue
+		}
+
+		album, ok := existing[prefix]
+		if !ok {
+			if album = s.newAutoAlbum(prefix); album == nil || configured[album.Path] {
+				continue
+			}
+		}
+
+		// folders like 'Baku' and 'baku!' end up at the same path, the first
+		// one keeps it
+		if otherPrefix, taken := prefixesByPath[album.Path]; taken {
+			fmt.Printf("\nSkipping discovered album %s for site %s, %s is already served at %s. Rename the folder, or "+
+				"add an INI section for it", prefix, s.Domain, otherPrefix, album.Path)
+			continue
+		}
+		prefixesByPath[album.Path] = prefix
+		autoAlbums = append(autoAlbums, album)
+	}
+
+	s.AutoAlbumCache.Store(autoAlbums)
+	s.LastAutoAlbumsUpdate.Store(time.Now())
+}
+
+// The prefixes and paths taken by albums configured in the INI file, discovered
+// albums using either are skipped.
+func (s *Site) getConfiguredPrefixesAndPaths() map[string]bool {
+	configured := make(map[string]bool)
+	for _, album := range s.Albums {
+		configured[album.BucketPrefix] = true
+		configured[album.Path] = true
+	}
+	return configured
+}
+
+// Builds the album for a discovered prefix, titled after the folder name. An
+// album.yaml in the folder can override that, like for any other album.
+func (s *Site) newAutoAlbum(prefix string) *Album {
+	name := strings.TrimSuffix(strings.TrimPrefix(prefix, s.AutoAlbumsPrefix), "/")
+	slug := slugify(name)
+	if slug == "" {
+		return nil
+	}
+
+	album, err := NewAlbum(s, "/"+slug+"/", prefix, "", "", "", name)
+	if err != nil {
+		fmt.Printf("\nUnable to create discovered album for prefix %s. Error: %s", prefix, err.Error())
+		return nil
+	}
+	return album
+}
+
+// Used when reloading configs, takes over the discovered albums of the old site
+// along with their caches, so we don't need to discover them all over again.
+func (s *Site) inheritAutoAlbumsFrom(old *Site) {
+	old.AutoAlbumsUpdateMutex.Lock()
+	defer old.AutoAlbumsUpdateMutex.Unlock()
+
+	oldAutoAlbums := old.getCachedAutoAlbums()
+	if oldAutoAlbums == nil {
+		return
+	}
+
+	configured := s.getConfiguredPrefixesAndPaths()
+
+	autoAlbums := make([]*Album, 0, len(oldAutoAlbums))
+	for _, oldAlbum := range oldAutoAlbums {
+		if configured[oldAlbum.BucketPrefix] || configured[oldAlbum.Path] {
+			continue
+		}
+
+		album, err := NewAlbum(s, oldAlbum.Path, oldAlbum.BucketPrefix, "", "", oldAlbum.MetaTitle, oldAlbum.AlbumTitle)
+		if err != nil {
+			continue
+		}
+		album.InheritCachesFrom(oldAlbum)
+		autoAlbums = append(autoAlbums, album)
+	}
+
+	s.AutoAlbumCache.Store(autoAlbums)
+	s.LastAutoAlbumsUpdate.Store(old.getLastAutoAlbumsUpdate())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestAutoAlbumsWithTheSamePath(t *testing.T) {
+	site := loadTestSite(t, "AutoAlbums = 1\n")
+	for _, folder := range []string{"Baku", "baku!", "Tbilisi"} {
+		if err := os.Mkdir(filepath.Join(site.StorageRoot, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths := make(map[string]string)
+	for _, album := range site.GetAutoAlbums() {
+		if other, ok := paths[album.Path]; ok {
+			t.Errorf("%s and %s are both served at %s", other, album.BucketPrefix, album.Path)
+		}
+		paths[album.Path] = album.BucketPrefix
+	}
+
+	expected := map[string]string{"/baku/": "Baku/", "/tbilisi/": "Tbilisi/", "/trips/": "trips/"}
+	for path, prefix := range expected {
+		if paths[path] != prefix {
+			t.Errorf("Expected %s to be served at %s, got %s", prefix, path, paths[path])
+		}
+	}
+	if len(paths) != len(expected) {
+		t.Errorf("Expected %d albums, got %v", len(expected), paths)
+	}
+}
+
+// run with -race, every call refreshes the albums in the background
+func TestAutoAlbumsConcurrentRefresh(t *testing.T) {
+	site := loadTestSite(t, "AutoAlbums = 1\nKeyCacheTTL = 1ns\n")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if len(site.GetAllAlbums()) != 1 {
+					t.Error("Expected the trips album")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// let the last refresh finish before the photos are removed
+	site.AutoAlbumsUpdateMutex.Lock()
+	site.AutoAlbumsUpdateMutex.Unlock()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const COMMANDS_USAGE = `Usage:
+  50mm                  start the server
+  50mm cache purge      purge album caches on a running server
+  50mm share create     create a share link for an album behind auth
+  50mm hash-password    hash a password for AuthPass or an AuthUsersFile
+`
+
+// Entry point for the command line, used when 50mm is called with arguments.
+func runCommand(args []string) error {
+	if len(args) >= 2 && args[0] == "cache" && args[1] == "purge" {
+		return runCachePurgeCommand(args[2:])
+	}
+	if len(args) >= 2 && args[0] == "share" && args[1] == "create" {
+		return runShareCreateCommand(args[2:])
+	}
+	if len(args) >= 1 && args[0] == "hash-password" {
+		return runHashPasswordCommand(args[1:])
+	}
+
+	fmt.Fprint(os.Stderr, COMMANDS_USAGE)
+	return fmt.Errorf("Unknown command '%s'", strings.Join(args, " "))
+}
+
+func runCachePurgeCommand(args []string) error {
+	port := os.Getenv(PORT_ENV_VAR)
+	if port == "" {
+		port = DEFAULT_PORT
+	}
+
+	flags := flag.NewFlagSet("cache purge", flag.ContinueOnError)
+	server := flags.String("server", "http://localhost:"+port, "URL of the running 50mm server")
+	site := flags.String("site", "", "domain of the site to purge, all sites if empty")
+	album := flags.String("album", "", "path of the album to purge, all albums in the site if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	user, pass := os.Getenv(ADMIN_USER_ENV_VAR), os.Getenv(ADMIN_PASS_ENV_VAR)
+	if user == "" || pass == "" {
+		return fmt.Errorf("%s and %s need to be set to the server's admin credentials", ADMIN_USER_ENV_VAR, ADMIN_PASS_ENV_VAR)
+	}
+
+	form := url.Values{}
+	if *site != "" {
+		form.Set("site", *site)
+	}
+	if *album != "" {
+		form.Set("album", *album)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*server, "/")+ADMIN_CACHE_PURGE_ROUTE,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(user, pass)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Println(strings.TrimRight(string(body), "\n"))
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// Share links are signed with the album's ShareSecret, so they're created
+// from the site configs rather than through the server.
+func runShareCreateCommand(args []string) error {
+	configDir := os.Getenv(CONFIG_DIR_ENV_VAR)
+	if configDir == "" {
+		configDir = DEFAULT_CONFIG_DIR
+	}
+
+	flags := flag.NewFlagSet("share create", flag.ContinueOnError)
+	config := flags.String("config", configDir, "the directory with the site configs")
+	domain := flags.String("site", "", "domain of the site the album is in")
+	albumPath := flags.String("album", "", "path of the album to share")
+	expires := flags.Duration("expires", DEFAULT_SHARE_DURATION, "how long the link works for")
+	maxUses := flags.Int("max-uses", 0, "how many times the link can be followed, 0 for no limit")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *domain == "" || *albumPath == "" {
+		return errors.New("-site and -album are required")
+	}
+
+	a := &App{configDir: *config}
+	a.LoadSites()
+	site, err := a.SiteForDomain(*domain)
+	if err != nil {
+		return err
+	}
+	album, err := site.GetAlbumForPath(*albumPath)
+	if err != nil {
+		return err
+	}
+	if !album.HasAuth() {
+		return fmt.Errorf("Album %s doesn't have auth, there's no need to share it", album.Path)
+	}
+	if album.ShareSecret == "" {
+		return fmt.Errorf("Album %s has no ShareSecret", album.Path)
+	}
+
+	token, err := album.NewShareToken(*expires, *maxUses)
+	if err != nil {
+		return err
+	}
+	fmt.Println(album.GetShareUrl(token))
+	return nil
+}
+
+// Reads the password from stdin, so it doesn't end up in the shell history.
+func runHashPasswordCommand(args []string) error {
+	flags := flag.NewFlagSet("hash-password", flag.ContinueOnError)
+	useArgon2 := flags.Bool("argon2", false, "use argon2id instead of bcrypt")
+	user := flags.String("user", "", "print a 'user:hash' line for an AuthUsersFile")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if strings.Contains(*user, ":") {
+		return errors.New("User names can't contain a ':'")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return errors.New("The password can't be empty")
+	}
+
+	var hash string
+	if *useArgon2 {
+		hash, err = HashPasswordWithArgon2(password)
+	} else {
+		hash, err = HashPasswordWithBcrypt(password)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *user != "" {
+		fmt.Printf("%s:%s\n", *user, hash)
+	} else {
+		fmt.Println(hash)
+	}
+	return nil
+}
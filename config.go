@@ -3,7 +3,12 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 const CONFIG_DIR_ENV_VAR = "FIFTYMM_CONFIG_DIR"
@@ -15,8 +20,14 @@ const DEFAULT_PORT = "8080"
 type App struct {
 	port string
 
+	adminUser string
+	adminPass string
+
 	configDir string
-	sites     map[string]*Site
+	siteFiles map[string]*Site // last good site loaded from each config file
+	sites     atomic.Value     // map[string]*Site, keyed by domain
+
+	reloadMutex sync.Mutex
 }
 
 func NewApp() *App {
@@ -30,10 +41,32 @@ func NewApp() *App {
 		configDir = DEFAULT_CONFIG_DIR
 	}
 
-	configFilesMap := make(map[string]*Site)
-	filepath.Walk(configDir, func(path string, info os.FileInfo, err error) error {
+	a := &App{
+		port:      port,
+		adminUser: os.Getenv(ADMIN_USER_ENV_VAR),
+		adminPass: os.Getenv(ADMIN_PASS_ENV_VAR),
+		configDir: configDir,
+	}
+	a.LoadSites()
+	return a
+}
+
+// LoadSites (re)reads every site config in the config dir and swaps them in
+// all at once. A config file that fails to load keeps serving the site that
+// was last loaded from it, and albums whose photos live in the same place as
+// before keep their caches.
+func (a *App) LoadSites() {
+	a.reloadMutex.Lock()
+	defer a.reloadMutex.Unlock()
+
+	siteFiles := make(map[string]*Site)
+	filepath.Walk(a.configDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
 		// We only look at the top level files in the config dir
-		if info.Mode().IsDir() && path != configDir {
+		if info.Mode().IsDir() && path != a.configDir {
 			return filepath.SkipDir
 		}
 
@@ -44,22 +77,60 @@ func NewApp() *App {
 		siteConfig, loadErr := LoadSiteFromFile(path)
 		if loadErr != nil {
 			fmt.Printf("Unable to load config from file %s. Error: %s\n", path, loadErr.Error())
+			if previous, ok := a.siteFiles[path]; ok {
+				fmt.Printf("Keeping previously loaded config for file %s\n", path)
+				siteFiles[path] = previous
+			}
 			return nil
 		}
 
-		configFilesMap[siteConfig.Domain] = siteConfig
+		siteFiles[path] = siteConfig
 		return nil
 	})
 
-	return &App{
-		port:      port,
-		configDir: configDir,
-		sites:     configFilesMap,
+	// walk the files in lexical order so that if two files configure the same
+	// domain, the same one wins every time.
+	paths := make([]string, 0, len(siteFiles))
+	for path := range siteFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	oldSites := a.getSites()
+	sites := make(map[string]*Site)
+	for _, path := range paths {
+		site := siteFiles[path]
+		if old, ok := oldSites[site.Domain]; ok && old != site {
+			site.InheritCachesFrom(old)
+		}
+		sites[site.Domain] = site
+	}
+
+	a.siteFiles = siteFiles
+	a.sites.Store(sites)
+}
+
+// Reloads the site configs every time the process receives a SIGHUP.
+func (a *App) ReloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			fmt.Println("Received SIGHUP, reloading site configs")
+			a.LoadSites()
+		}
+	}()
+}
+
+func (a *App) getSites() map[string]*Site {
+	if sites := a.sites.Load(); sites != nil {
+		return sites.(map[string]*Site)
 	}
+	return nil
 }
 
 func (a *App) SiteForDomain(domain string) (*Site, error) {
-	if cs, ok := a.sites[domain]; !ok {
+	if cs, ok := a.getSites()[domain]; !ok {
 		return nil, fmt.Errorf("No site configured for domain %s", domain)
 	} else {
 		return cs, nil
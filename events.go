@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bucket event notifications (SNS over HTTP, or MinIO webhook targets) are
+// POSTed to this path on the site's domain.
+const S3_EVENTS_ROUTE = "/_events/s3"
+
+const SNS_MESSAGE_TYPE_HEADER = "X-Amz-Sns-Message-Type"
+
+// SNS messages are at most 256KB, MinIO batches are smaller than that too
+const MAX_EVENTS_BODY_BYTES = 1024 * 1024
+
+// SNS signing certs and subscribe URLs must come from SNS itself
+var snsHostPattern = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsCertCache = make(map[string]*x509.Certificate)
+var snsCertCacheMutex sync.Mutex
+
+var snsHttpClient = &http.Client{Timeout: 10 * time.Second}
+
+// The envelope SNS wraps around every message it delivers over HTTP(S)
+type SNSMessage struct {
+	Type             string
+	MessageId        string
+	Token            string
+	TopicArn         string
+	Subject          string
+	Message          string
+	Timestamp        string
+	SignatureVersion string
+	Signature        string
+	SigningCertURL   string
+	SubscribeURL     string
+}
+
+// The S3 event notification format, as sent by both S3 and MinIO. We only
+// read the fields we need.
+type S3EventNotification struct {
+	Records []S3EventRecord
+}
+
+type S3EventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+func (s *Site) HasS3Events() bool {
+	return s.EventTopicArn != "" || s.EventWebhookToken != ""
+}
+
+func handleS3Events(site *Site, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_EVENTS_BODY_BYTES))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var notification S3EventNotification
+	if r.Header.Get(SNS_MESSAGE_TYPE_HEADER) != "" {
+		if site.EventTopicArn == "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("SNS notifications aren't enabled for this site\n"))
+			return
+		}
+
+		var msg SNSMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if msg.TopicArn != site.EventTopicArn {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Unknown SNS topic\n"))
+			return
+		}
+		if err := msg.Verify(); err != nil {
+			log.Printf("Rejected SNS message for site %s. Error: %s\n", site.Domain, err.Error())
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		switch msg.Type {
+		case "SubscriptionConfirmation":
+			if err := msg.ConfirmSubscription(); err != nil {
+				log.Printf("Unable to confirm SNS subscription for site %s. Error: %s\n", site.Domain, err.Error())
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			log.Printf("Confirmed SNS subscription to %s for site %s\n", msg.TopicArn, site.Domain)
+			return
+		case "Notification":
+			if err := json.Unmarshal([]byte(msg.Message), &notification); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		default:
+			// nothing to do for UnsubscribeConfirmation
+			return
+		}
+	} else {
+		// MinIO sends the configured auth_token as the Authorization header
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if site.EventWebhookToken == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(site.EventWebhookToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Unauthorized\n"))
+			return
+		}
+
+		if err := json.Unmarshal(body, &notification); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	site.HandleS3Events(notification.Records)
+}
+
+// Refreshes the caches affected by the events. A new ordering or album.yaml
+// file only refreshes the matching cache of its album, any other object
+// refreshes the key cache. Each album is refreshed at most once per batch of events.
+func (s *Site) HandleS3Events(records []S3EventRecord) {
+	keyCacheAlbums := make(map[*Album]bool)
+	orderingCacheAlbums := make(map[*Album]bool)
+	metadataCacheAlbums := make(map[*Album]bool)
+
+	for _, record := range records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") &&
+			!strings.HasPrefix(record.EventName, "ObjectRemoved:") &&
+			!strings.HasPrefix(record.EventName, "s3:ObjectCreated:") &&
+			!strings.HasPrefix(record.EventName, "s3:ObjectRemoved:") {
+			continue
+		}
+		if record.S3.Bucket.Name != s.BucketName {
+			continue
+		}
+
+		// keys in event notifications are URL encoded
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			continue
+		}
+
+		album, exact := s.GetNearestAlbumForKey(key)
+		if album == nil {
+			continue
+		}
+
+		if !exact {
+			// a folder we don't know about yet, refreshing the keys of its
+			// parent album picks it up as a new sub album.
+			keyCacheAlbums[album] = true
+		} else if path.Base(key) == ORDERING_YAML_NAME {
+			orderingCacheAlbums[album] = true
+		} else if path.Base(key) == ALBUM_YAML_NAME {
+			metadataCacheAlbums[album] = true
+		} else {
+			keyCacheAlbums[album] = true
+		}
+	}
+
+	for album := range keyCacheAlbums {
+		if err := album.PurgeKeyCache(); err != nil {
+			log.Printf("Unable to refresh keys for album %s. Error: %s\n", album.Path, err.Error())
+		}
+	}
+	for album := range orderingCacheAlbums {
+		if err := album.PurgeOrderingCache(); err != nil {
+			log.Printf("Unable to refresh ordering for album %s. Error: %s\n", album.Path, err.Error())
+		}
+	}
+	for album := range metadataCacheAlbums {
+		if err := album.PurgeMetadataCache(); err != nil {
+			log.Printf("Unable to refresh metadata for album %s. Error: %s\n", album.Path, err.Error())
+		}
+	}
+}
+
+// Checks the message was signed by SNS, see:
+// https://docs.aws.amazon.com/sns/latest/dg/sns-verify-signature-of-message.html
+func (m *SNSMessage) Verify() error {
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return err
+	}
+
+	cert, err := getSNSSigningCert(m.SigningCertURL)
+	if err != nil {
+		return err
+	}
+
+	var algorithm x509.SignatureAlgorithm
+	switch m.SignatureVersion {
+	case "1":
+		algorithm = x509.SHA1WithRSA
+	case "2":
+		algorithm = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("Unsupported SNS signature version '%s'", m.SignatureVersion)
+	}
+
+	return cert.CheckSignature(algorithm, m.stringToSign(), signature)
+}
+
+func (m *SNSMessage) stringToSign() []byte {
+	var fields [][2]string
+	if m.Type == "Notification" {
+		fields = [][2]string{{"Message", m.Message}, {"MessageId", m.MessageId}}
+		if m.Subject != "" {
+			fields = append(fields, [2]string{"Subject", m.Subject})
+		}
+		fields = append(fields, [][2]string{{"Timestamp", m.Timestamp}, {"TopicArn", m.TopicArn}, {"Type", m.Type}}...)
+	} else {
+		fields = [][2]string{
+			{"Message", m.Message},
+			{"MessageId", m.MessageId},
+			{"SubscribeURL", m.SubscribeURL},
+			{"Timestamp", m.Timestamp},
+			{"Token", m.Token},
+			{"TopicArn", m.TopicArn},
+			{"Type", m.Type},
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, field := range fields {
+		buf.WriteString(field[0] + "\n" + field[1] + "\n")
+	}
+	return buf.Bytes()
+}
+
+func (m *SNSMessage) ConfirmSubscription() error {
+	if err := checkSNSUrl(m.SubscribeURL); err != nil {
+		return err
+	}
+
+	resp, err := snsHttpClient.Get(m.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("SNS responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func checkSNSUrl(rawUrl string) error {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || !snsHostPattern.MatchString(u.Host) {
+		return fmt.Errorf("'%s' is not an SNS URL", rawUrl)
+	}
+	return nil
+}
+
+// Fetches (and caches) the certificate SNS signed a message with, making sure
+// it's served by SNS and is a valid certificate.
+func getSNSSigningCert(certUrl string) (*x509.Certificate, error) {
+	snsCertCacheMutex.Lock()
+	defer snsCertCacheMutex.Unlock()
+
+	if cert, ok := snsCertCache[certUrl]; ok && time.Now().Before(cert.NotAfter) {
+		return cert, nil
+	}
+
+	if err := checkSNSUrl(certUrl); err != nil {
+		return nil, err
+	}
+	parsedUrl, _ := url.Parse(certUrl)
+
+	resp, err := snsHttpClient.Get(certUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	certBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return nil, errors.New("SNS signing cert: No PEM block found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: parsedUrl.Host}); err != nil {
+		return nil, err
+	}
+
+	snsCertCache[certUrl] = cert
+	return cert, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_TOPIC_ARN = "arn:aws:sns:us-west-2:123456789012:50mm-events"
+const TEST_WEBHOOK_TOKEN = "minio-webhook-token"
+
+// A site that accepts events. Events are only allowed with S3 storage, but
+// the handler doesn't care where the photos come from.
+func loadTestEventsSite(t *testing.T) (*Site, *Album) {
+	site := loadTestSite(t, "[Trips]\nPath = /trips/\nBucketPrefix = trips/\n")
+	site.BucketName = "photos"
+	site.EventTopicArn = TEST_TOPIC_ARN
+	site.EventWebhookToken = TEST_WEBHOOK_TOKEN
+
+	writeTestPhoto(t, site, "trips/beach.jpg")
+	album, err := site.GetAlbumForPath("/trips/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := album.GetAllObjectKeys(); err != nil || len(keys) != 1 {
+		t.Fatalf("Expected the album to start with 1 photo, got %v %v", keys, err)
+	}
+
+	// the notifications are about this one
+	writeTestPhoto(t, site, "trips/sunset over the sea.jpg")
+	return site, album
+}
+
+func hasKey(album *Album, suffix string) bool {
+	keys, _ := album.KeyCache.Load().([]string)
+	for _, key := range keys {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadSNSMessage(t *testing.T, name string) *SNSMessage {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "events", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &SNSMessage{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// The recorded SNS messages were signed by AWS, so we sign them again with a
+// certificate of our own, which we put in the cache for their SigningCertURL.
+func signSNSMessage(t *testing.T, msg *SNSMessage) *SNSMessage {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snsCertCacheMutex.Lock()
+	snsCertCache[msg.SigningCertURL] = cert
+	snsCertCacheMutex.Unlock()
+
+	var signature []byte
+	if msg.SignatureVersion == "1" {
+		hash := sha1.Sum(msg.stringToSign())
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, hash[:])
+	} else {
+		hash := sha256.Sum256(msg.stringToSign())
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Signature = base64.StdEncoding.EncodeToString(signature)
+	return msg
+}
+
+func postSNSMessage(site *Site, msg *SNSMessage) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(msg)
+	r := httptest.NewRequest(http.MethodPost, S3_EVENTS_ROUTE, strings.NewReader(string(body)))
+	r.Header.Set(SNS_MESSAGE_TYPE_HEADER, msg.Type)
+	w := httptest.NewRecorder()
+	handleS3Events(site, w, r)
+	return w
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// Records the URLs SNS would have been asked for
+func stubSNSHttpClient(t *testing.T) *[]string {
+	var requested []string
+	oldClient := snsHttpClient
+	snsHttpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		requested = append(requested, r.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("<ConfirmSubscriptionResponse/>")),
+			Request:    r,
+		}, nil
+	})}
+	t.Cleanup(func() { snsHttpClient = oldClient })
+	return &requested
+}
+
+func TestSNSSubscriptionConfirmation(t *testing.T) {
+	site, _ := loadTestEventsSite(t)
+	requested := stubSNSHttpClient(t)
+	msg := signSNSMessage(t, loadSNSMessage(t, "sns_subscription_confirmation.json"))
+
+	if w := postSNSMessage(site, msg); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if len(*requested) != 1 || (*requested)[0] != msg.SubscribeURL {
+		t.Errorf("Expected the SubscribeURL to be visited, got %v", *requested)
+	}
+}
+
+func TestSNSSubscriptionConfirmationOutsideSNS(t *testing.T) {
+	site, _ := loadTestEventsSite(t)
+	requested := stubSNSHttpClient(t)
+	msg := loadSNSMessage(t, "sns_subscription_confirmation.json")
+	msg.SubscribeURL = "https://sns.us-west-2.amazonaws.com.evil.com/?Action=ConfirmSubscription"
+	signSNSMessage(t, msg)
+
+	if w := postSNSMessage(site, msg); w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502, got %d %s", w.Code, w.Body.String())
+	}
+	if len(*requested) != 0 {
+		t.Errorf("Expected no requests outside SNS, got %v", *requested)
+	}
+}
+
+func TestSNSNotification(t *testing.T) {
+	site, album := loadTestEventsSite(t)
+	msg := signSNSMessage(t, loadSNSMessage(t, "sns_notification.json"))
+
+	if w := postSNSMessage(site, msg); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if !hasKey(album, "sunset over the sea.jpg") {
+		t.Error("Expected the notification to refresh the album's keys")
+	}
+}
+
+func TestSNSBadSignature(t *testing.T) {
+	site, album := loadTestEventsSite(t)
+	requested := stubSNSHttpClient(t)
+
+	msg := signSNSMessage(t, loadSNSMessage(t, "sns_notification.json"))
+	msg.Message = strings.Replace(msg.Message, "sunset", "sunrise", 1)
+	if w := postSNSMessage(site, msg); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a changed message, got %d", w.Code)
+	}
+
+	msg = signSNSMessage(t, loadSNSMessage(t, "sns_subscription_confirmation.json"))
+	msg.Signature = base64.StdEncoding.EncodeToString([]byte("not a signature"))
+	if w := postSNSMessage(site, msg); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a bad signature, got %d", w.Code)
+	}
+
+	if hasKey(album, "sunset over the sea.jpg") {
+		t.Error("Expected the album's keys not to be refreshed")
+	}
+	if len(*requested) != 0 {
+		t.Errorf("Expected the subscription not to be confirmed, got %v", *requested)
+	}
+}
+
+func TestSNSUnknownTopic(t *testing.T) {
+	site, _ := loadTestEventsSite(t)
+	site.EventTopicArn = "arn:aws:sns:us-west-2:123456789012:other-topic"
+
+	msg := signSNSMessage(t, loadSNSMessage(t, "sns_notification.json"))
+	if w := postSNSMessage(site, msg); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", w.Code)
+	}
+}
+
+func postMinioEvents(t *testing.T, site *Site, token string) *httptest.ResponseRecorder {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "events", "minio_put.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, S3_EVENTS_ROUTE, strings.NewReader(string(body)))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handleS3Events(site, w, r)
+	return w
+}
+
+func TestMinioNotification(t *testing.T) {
+	site, album := loadTestEventsSite(t)
+
+	if w := postMinioEvents(t, site, "wrong-token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong token, got %d", w.Code)
+	}
+	if hasKey(album, "sunset over the sea.jpg") {
+		t.Fatal("Expected the album's keys not to be refreshed without the token")
+	}
+
+	if w := postMinioEvents(t, site, TEST_WEBHOOK_TOKEN); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	if !hasKey(album, "sunset over the sea.jpg") {
+		t.Error("Expected the notification to refresh the album's keys")
+	}
+}
+
+func TestS3EventsBodyLimit(t *testing.T) {
+	site, album := loadTestEventsSite(t)
+
+	body := `{"Records":[],"padding":"` + strings.Repeat("x", MAX_EVENTS_BODY_BYTES) + `"}`
+	r := httptest.NewRequest(http.MethodPost, S3_EVENTS_ROUTE, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+TEST_WEBHOOK_TOKEN)
+	w := httptest.NewRecorder()
+	handleS3Events(site, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+	if hasKey(album, "sunset over the sea.jpg") {
+		t.Error("Expected the album's keys not to be refreshed")
+	}
+}
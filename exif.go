@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// We only fetch the first 128KB of a photo to read its EXIF data. JPEGs keep
+// it in a segment of at most 64KB near the start, the rest leaves room for
+// the segments that can come before it.
+const EXIF_HEADER_BYTES = 128 * 1024
+
+const EXIF_DATE_FORMAT = "2 January 2006, 15:04"
+
+// The camera details of a photo, as recorded by the camera. Anything it didn't
+// record is left empty.
+type PhotoExif struct {
+	Camera       string    `json:"camera,omitempty"`
+	Lens         string    `json:"lens,omitempty"`
+	FocalLength  float64   `json:"focal_length,omitempty"`  // in mm
+	Aperture     float64   `json:"aperture,omitempty"`      // f-number
+	ExposureTime float64   `json:"exposure_time,omitempty"` // in seconds
+	ISO          int       `json:"iso,omitempty"`
+	Taken        time.Time `json:"taken"` // DateTimeOriginal
+}
+
+type exifCacheEntry struct {
+	exif         *PhotoExif // nil if the photo has no EXIF data
+	lastModified time.Time  // of the object we read exif from
+}
+
+// Reads the EXIF data from the start of the object. Returns nil, and no error,
+// if the object doesn't have any.
+func ReadExifFromStorage(storage Storage, key string) (*PhotoExif, error) {
+	object, err := storage.GetObjectRange(key, 0, EXIF_HEADER_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	x, err := exif.Decode(object)
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		// not a photo, or one without EXIF data
+		return nil, nil
+	}
+
+	photoExif := &PhotoExif{}
+	photoExif.Camera = cameraName(exifString(x, exif.Make), exifString(x, exif.Model))
+	photoExif.Lens = exifString(x, exif.LensModel)
+	photoExif.FocalLength = exifFloat(x, exif.FocalLength)
+	photoExif.Aperture = exifFloat(x, exif.FNumber)
+	photoExif.ExposureTime = exifFloat(x, exif.ExposureTime)
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		photoExif.ISO, _ = tag.Int(0)
+	}
+	if taken, err := x.DateTime(); err == nil {
+		photoExif.Taken = taken
+	}
+
+	if *photoExif == (PhotoExif{}) {
+		return nil, nil
+	}
+	return photoExif, nil
+}
+
+// The EXIF Orientation of a photo, from 1 (upright) to 8. Photos without one
+// are upright.
+func ReadExifOrientation(data []byte) int {
+	x, err := exif.Decode(bytes.NewReader(data))
+	if err != nil && (x == nil || exif.IsCriticalError(err)) {
+		return 1
+	}
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	orientation, err := tag.Int(0)
+	if err != nil {
+		return 1
+	}
+	return orientation
+}
+
+func exifString(x *exif.Exif, field exif.FieldName) string {
+	tag, err := x.Get(field)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, field exif.FieldName) float64 {
+	tag, err := x.Get(field)
+	if err != nil {
+		return 0
+	}
+	num, den, err := tag.Rat2(0)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// Most cameras repeat the make in the model (e.g: 'NIKON CORPORATION' and
+// 'NIKON D750'), we don't want it twice.
+func cameraName(cameraMake, model string) string {
+	if cameraMake == "" || model == "" {
+		return cameraMake + model
+	}
+	brand := strings.ToLower(strings.Fields(cameraMake)[0])
+	if strings.HasPrefix(strings.ToLower(model), brand) {
+		return model
+	}
+	return cameraMake + " " + model
+}
+
+func formatDecimal(f float64) string {
+	return strconv.FormatFloat(math.Round(f*10)/10, 'f', -1, 64)
+}
+
+func (e *PhotoExif) GetFocalLength() string {
+	if e.FocalLength <= 0 {
+		return ""
+	}
+	return formatDecimal(e.FocalLength) + "mm"
+}
+
+func (e *PhotoExif) GetAperture() string {
+	if e.Aperture <= 0 {
+		return ""
+	}
+	return "f/" + formatDecimal(e.Aperture)
+}
+
+// Exposures shorter than a second are shown as fractions, as on cameras
+func (e *PhotoExif) GetShutterSpeed() string {
+	if e.ExposureTime <= 0 {
+		return ""
+	}
+	if e.ExposureTime < 1 {
+		return fmt.Sprintf("1/%.0fs", 1/e.ExposureTime)
+	}
+	return formatDecimal(e.ExposureTime) + "s"
+}
+
+func (e *PhotoExif) GetTaken() string {
+	if e.Taken.IsZero() {
+		return ""
+	}
+	return e.Taken.Format(EXIF_DATE_FORMAT)
+}
+
+// The EXIF data of a photo in the album, nil if there isn't any. Photos are
+// only read again when the key cache sees they've changed.
+func (a *Album) GetExifForKey(key string) *PhotoExif {
+	var lastModified time.Time
+	if _, err := a.GetAllObjectKeys(); err == nil {
+		if object, ok := a.getCachedObjects()[key]; ok {
+			lastModified = object.LastModified
+		}
+	}
+	return a.getExifForObject(key, lastModified)
+}
+
+// Like GetExifForKey, for callers that know when the photo was last modified.
+// The key cache isn't touched, so this works while it's being refreshed.
+func (a *Album) getExifForObject(key string, lastModified time.Time) *PhotoExif {
+	a.ExifCacheMutex.Lock()
+	entry, ok := a.ExifCache[key]
+	a.ExifCacheMutex.Unlock()
+	if ok && entry.lastModified.Equal(lastModified) {
+		return entry.exif
+	}
+
+	photoExif, err := ReadExifFromStorage(a.site.GetStorage(), key)
+	if err != nil {
+		if err != ErrObjectNotFound {
+			log.Printf("Unable to read EXIF data of %s for album %s. Error: %s\n", key, a.Path, err.Error())
+		}
+		return nil
+	}
+
+	a.ExifCacheMutex.Lock()
+	if a.ExifCache == nil {
+		a.ExifCache = make(map[string]*exifCacheEntry)
+	}
+	a.ExifCache[key] = &exifCacheEntry{photoExif, lastModified}
+	a.ExifCacheMutex.Unlock()
+
+	return photoExif
+}
+
+// Drops the EXIF data of photos that are no longer in the album
+func (a *Album) pruneExifCache(objects map[string]*StorageObject) {
+	a.ExifCacheMutex.Lock()
+	defer a.ExifCacheMutex.Unlock()
+
+	for key := range a.ExifCache {
+		if _, ok := objects[key]; !ok {
+			delete(a.ExifCache, key)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// RSS feeds of the albums on a site (at /feed.xml), and of the photos in an
+// album (at <album path>feed.xml), with Media RSS thumbnails.
+const FEED_SLUG = "feed.xml"
+const FEED_MAX_ITEMS = 50
+const FEED_THUMBNAIL_WIDTH = 600
+const FEED_THUMBNAIL_HEIGHT = 400
+
+type RssFeed struct {
+	XMLName xml.Name    `xml:"rss"`
+	Version string      `xml:"version,attr"`
+	MediaNs string      `xml:"xmlns:media,attr"`
+	AtomNs  string      `xml:"xmlns:atom,attr"`
+	Channel *RssChannel `xml:"channel"`
+}
+
+type RssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	Self          *AtomLink  `xml:"atom:link"`
+	LastBuildDate string     `xml:"lastBuildDate,omitempty"`
+	Items         []*RssItem `xml:"item"`
+}
+
+// lets feed readers know where the feed lives
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type RssItem struct {
+	Title       string        `xml:"title"`
+	Link        string        `xml:"link"`
+	Guid        string        `xml:"guid"`
+	PubDate     string        `xml:"pubDate,omitempty"`
+	Description string        `xml:"description,omitempty"`
+	Media       *MediaContent `xml:"media:content,omitempty"`
+}
+
+type MediaContent struct {
+	Url    string `xml:"url,attr"`
+	Medium string `xml:"medium,attr"`
+}
+
+func newRssFeed(title, link, description, feedUrl string, lastBuild time.Time, items []*RssItem) *RssFeed {
+	channel := &RssChannel{
+		Title:       title,
+		Link:        link,
+		Description: description,
+		Self:        &AtomLink{feedUrl, "self", "application/rss+xml"},
+		Items:       items,
+	}
+	if !lastBuild.IsZero() {
+		channel.LastBuildDate = lastBuild.Format(time.RFC1123Z)
+	}
+	return &RssFeed{
+		Version: "2.0",
+		MediaNs: "http://search.yahoo.com/mrss/",
+		AtomNs:  "http://www.w3.org/2005/Atom",
+		Channel: channel,
+	}
+}
+
+func newMediaContent(photo Renderable) *MediaContent {
+	thumbnailUrl := photo.GetThumbnailForWidthAndHeight(FEED_THUMBNAIL_WIDTH, FEED_THUMBNAIL_HEIGHT)
+	if thumbnailUrl == "" {
+		return nil
+	}
+	return &MediaContent{thumbnailUrl, "image"}
+}
+
+// When the newest object in the album was uploaded
+func (a *Album) GetLastModified() time.Time {
+	var lastModified time.Time
+	if _, err := a.GetAllObjectKeys(); err != nil {
+		return lastModified
+	}
+	for _, object := range a.getCachedObjects() {
+		if object.LastModified.After(lastModified) {
+			lastModified = object.LastModified
+		}
+	}
+	return lastModified
+}
+
+// The albums on the site index, newest first. Albums behind auth never show up
+// here, even if the site is behind auth, their feeds need the credentials.
+func handleSiteFeed(site *Site, w http.ResponseWriter, r *http.Request) {
+	var albums []*Album
+	lastModified := make(map[*Album]time.Time)
+	for _, album := range site.GetAlbumsForIndex() {
+		if !album.HasAuth() {
+			albums = append(albums, album)
+			lastModified[album] = album.GetLastModified()
+		}
+	}
+	sort.SliceStable(albums, func(i, j int) bool {
+		return lastModified[albums[i]].After(lastModified[albums[j]])
+	})
+	if len(albums) > FEED_MAX_ITEMS {
+		albums = albums[:FEED_MAX_ITEMS]
+	}
+
+	var lastBuild time.Time
+	items := make([]*RssItem, 0, len(albums))
+	for _, album := range albums {
+		albumUrl := album.GetCanonicalUrl().String()
+		item := &RssItem{
+			Title:       album.GetAlbumTitle(),
+			Link:        albumUrl,
+			Guid:        albumUrl,
+			Description: string(album.GetDescription()),
+			Media:       newMediaContent(album.GetCoverPhotoForTemplate()),
+		}
+		if t := lastModified[album]; !t.IsZero() {
+			item.PubDate = t.Format(time.RFC1123Z)
+			if t.After(lastBuild) {
+				lastBuild = t
+			}
+		}
+		items = append(items, item)
+	}
+
+	description := site.MetaTitle
+	if description == "" {
+		description = site.SiteTitle
+	}
+	feedUrl := site.GetCanonicalUrl()
+	feedUrl.Path = "/" + FEED_SLUG
+	writeFeed(w, newRssFeed(site.SiteTitle, site.GetCanonicalUrl().String(), description, feedUrl.String(), lastBuild, items))
+}
+
+// The photos of the album, newest first
+func handleAlbumFeed(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	albumOrdering, err := album.GetOrderedPhotos()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	objects := album.getCachedObjects()
+	photoLastModified := func(photo *CaptionedPhoto) time.Time {
+		if object, ok := objects[album.BucketPrefix+photo.Slug()]; ok {
+			return object.LastModified
+		}
+		return time.Time{}
+	}
+
+	photos := make([]*CaptionedPhoto, len(albumOrdering.Ordering))
+	copy(photos, albumOrdering.Ordering)
+	sort.SliceStable(photos, func(i, j int) bool {
+		return photoLastModified(photos[i]).After(photoLastModified(photos[j]))
+	})
+	if len(photos) > FEED_MAX_ITEMS {
+		photos = photos[:FEED_MAX_ITEMS]
+	}
+
+	var lastBuild time.Time
+	albumUrl := album.GetCanonicalUrl().String()
+	items := make([]*RssItem, 0, len(photos))
+	for _, photo := range photos {
+		item := &RssItem{
+			Title:       photo.GetDisplayTitle(),
+			Link:        albumUrl + photo.Slug(),
+			Guid:        albumUrl + photo.Slug(),
+			Description: photo.Caption,
+			Media:       newMediaContent(photo),
+		}
+		if t := photoLastModified(photo); !t.IsZero() {
+			item.PubDate = t.Format(time.RFC1123Z)
+			if t.After(lastBuild) {
+				lastBuild = t
+			}
+		}
+		items = append(items, item)
+	}
+
+	description := string(album.GetDescription())
+	if description == "" {
+		description = album.GetMetaTitle()
+	}
+	writeFeed(w, newRssFeed(album.GetAlbumTitle(), albumUrl, description, albumUrl+FEED_SLUG, lastBuild, items))
+}
+
+func writeFeed(w http.ResponseWriter, feed *RssFeed) {
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(feed); err != nil {
+		log.Printf("Unable to write feed. Error: %s\n", err.Error())
+	}
+}
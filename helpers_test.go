@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Loads a site from config, which is added to the DEFAULT section of an INI
+// file, with its photos in a temporary directory.
+func loadTestSite(t *testing.T, config string) *Site {
+	t.Helper()
+
+	dir := t.TempDir()
+	photos := filepath.Join(dir, "photos")
+	if err := os.MkdirAll(filepath.Join(photos, "trips"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return loadTestSiteFromIni(t, "Domain = photos.example.com\nStorage = filesystem\nStorageRoot = "+photos+"\n"+config)
+}
+
+func loadTestSiteFromIni(t *testing.T, ini string) *Site {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "site.ini")
+	if err := ioutil.WriteFile(path, []byte(ini), 0644); err != nil {
+		t.Fatal(err)
+	}
+	site, err := LoadSiteFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return site
+}
+
+func writeTestPhoto(t *testing.T, site *Site, key string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(site.StorageRoot, key), []byte("not really a photo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The session cookies the response sets, not the ones it clears
+func getSessionCookies(w *httptest.ResponseRecorder) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if strings.HasPrefix(cookie.Name, SESSION_COOKIE_PREFIX) && cookie.MaxAge >= 0 {
+			cookies = append(cookies, cookie)
+		}
+	}
+	return cookies
+}
+
+func boolPointer(b bool) *bool {
+	return &b
+}
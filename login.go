@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Sites and albums with AuthMode = form show a login page instead of asking
+// for basic auth. The page posts to LOGIN_ROUTE, which starts a session and
+// sends the visitor back where they were. Posting to LOGOUT_ROUTE ends all of
+// them, it doesn't take GETs so other sites can't log visitors out with an
+// image.
+const LOGIN_ROUTE = "/_login"
+const LOGOUT_ROUTE = "/_logout"
+
+type LoginPageContext struct {
+	*BasePageContext
+
+	Title string // of the site or album the visitor is logging in to
+	Album string // path of the album, empty when logging in to the site
+	Next  string
+	Error string
+}
+
+// Shows the login page for the provider, with a 401 so that nothing caches it
+// in place of the page the visitor asked for.
+func renderLoginPage(w http.ResponseWriter, provider AuthCredentialsProvider, next string, errorMessage string) {
+	site := getSiteForProvider(provider)
+	ctx := &LoginPageContext{
+		&BasePageContext{
+			site.GetCanonicalUrl().String(),
+			site.GetCanonicalUrl().String(),
+			site.MetaTitle,
+			site.SiteTitle,
+			site.GetSrcSetWidths(),
+			site.GetOutputFormats(),
+			true,
+			"",
+		},
+		site.SiteTitle,
+		"",
+		next,
+		errorMessage,
+	}
+	if album, ok := provider.(*Album); ok {
+		ctx.CanonicalUrl = album.GetCanonicalUrl().String()
+		ctx.MetaTitle = album.GetMetaTitle()
+		ctx.Title = album.GetAlbumTitle()
+		ctx.Album = album.Path
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	executeTemplateHelper(w, "login.html", ctx)
+}
+
+// Only paths on this site, so the login page can't be used to send visitors
+// elsewhere. Browsers drop tabs and newlines from URLs and treat backslashes
+// as slashes, so '/\t/evil.com' would be '//evil.com' to them.
+func getSafeRedirectPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.ContainsRune(next, '\\') || strings.IndexFunc(next, isAsciiControl) >= 0 {
+		return "/"
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	path := u.RequestURI()
+	if strings.HasPrefix(path, "//") {
+		return "/"
+	}
+	return path
+}
+
+func isAsciiControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+func handleLogin(site *Site, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	var provider AuthCredentialsProvider = site
+	if albumPath := r.PostFormValue("album"); albumPath != "" {
+		album, err := site.GetAlbumForPath(albumPath)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		provider = album
+	}
+
+	next := getSafeRedirectPath(r.PostFormValue("next"))
+	if provider.GetAuthMode() != AUTH_MODE_FORM {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+
+	user := r.PostFormValue("user")
+	if !checkCredentials(provider, user, r.PostFormValue("password")) {
+		renderLoginPage(w, provider, next, "Wrong username or password")
+		return
+	}
+
+	if err := startSession(w, r, provider, user); err != nil {
+		log.Printf("Unable to start session on site %s. Error: %s\n", site.Domain, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func handleLogout(site *Site, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	endSessions(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Pages behind a login get a link to log out, basic auth has no such thing
+func (s *Site) GetLogoutUrl() string {
+	if s.HasAuth() && s.GetAuthMode() != AUTH_MODE_BASIC {
+		return LOGOUT_ROUTE
+	}
+	return ""
+}
+
+func (a *Album) GetLogoutUrl() string {
+	if a.HasAuth() && a.GetAuthMode() != AUTH_MODE_BASIC {
+		return LOGOUT_ROUTE
+	}
+	return ""
+}
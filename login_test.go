@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetSafeRedirectPath(t *testing.T) {
+	tests := map[string]string{
+		"":                        "/",
+		"/":                       "/",
+		"/album/":                 "/album/",
+		"/album/?page=2":          "/album/?page=2",
+		"/album/photo.jpg#top":    "/album/photo.jpg",
+		"album/":                  "/",
+		"https://evil.com/":       "/",
+		"//evil.com":              "/",
+		"///evil.com":             "/",
+		"////evil.com":            "/",
+		"/\\evil.com":             "/",
+		"/\t/evil.com":            "/",
+		"/\n/evil.com":            "/",
+		"/\x7f/evil.com":          "/",
+		"/%2F%2Fevil.com":         "/%2F%2Fevil.com",
+		"/album/%09/":             "/album/%09/",
+		"/@evil.com":              "/@evil.com",
+		"javascript:alert(1)":     "/",
+		"/été/":                   "/%C3%A9t%C3%A9/",
+		"http://localhost/album/": "/",
+	}
+
+	for next, expected := range tests {
+		if path := getSafeRedirectPath(next); path != expected {
+			t.Errorf("getSafeRedirectPath(%q) = %q, expected %q", next, path, expected)
+		}
+	}
+}
+
+// A site behind a login page, with a public album and a private one
+func loadTestFormSite(t *testing.T) *Site {
+	site := loadTestSite(t, "[Trips]\nPath = /trips/\nBucketPrefix = trips/\nInIndex = 0\n"+
+		"AuthUser = alice\nAuthPass = secret\nAuthMode = form\n"+
+		"[Public]\nPath = /public/\nBucketPrefix = public/\n")
+	if err := os.MkdirAll(filepath.Join(site.StorageRoot, "public"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestPhoto(t, site, "trips/beach.jpg")
+	writeTestPhoto(t, site, "public/beach.jpg")
+	return site
+}
+
+func testFormLogin(t *testing.T, site *Site) *http.Cookie {
+	t.Helper()
+
+	form := url.Values{"album": {"/trips/"}, "user": {"alice"}, "password": {"secret"}, "next": {"/trips/"}}
+	r := httptest.NewRequest(http.MethodPost, LOGIN_ROUTE, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handleLogin(site, w, r)
+
+	cookies := getSessionCookies(w)
+	if w.Code != http.StatusSeeOther || len(cookies) != 1 {
+		t.Fatalf("Expected a session, got %d %v", w.Code, w.Result().Cookies())
+	}
+	return cookies[0]
+}
+
+func TestPrivateResponsesAreNotCached(t *testing.T) {
+	site := loadTestFormSite(t)
+	cookie := testFormLogin(t, site)
+
+	r := httptest.NewRequest(http.MethodGet, FILESYSTEM_STORAGE_ROUTE+"trips/beach.jpg", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handleStorageObject(site, "trips/beach.jpg", w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the photo, got %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Cache-Control") != "private" || w.Header().Get("Vary") != "Cookie" {
+		t.Errorf("Expected a photo served for a session to be private, got Cache-Control %q, Vary %q",
+			w.Header().Get("Cache-Control"), w.Header().Get("Vary"))
+	}
+
+	w = httptest.NewRecorder()
+	handleStorageObject(site, "public/beach.jpg", w, httptest.NewRequest(http.MethodGet, FILESYSTEM_STORAGE_ROUTE+"public/beach.jpg", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("Expected a public photo without Cache-Control, got %d %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestLogout(t *testing.T) {
+	site := loadTestFormSite(t)
+	cookie := testFormLogin(t, site)
+
+	// e.g. <img src="/_logout"> on another site
+	r := httptest.NewRequest(http.MethodGet, LOGOUT_ROUTE, nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handleLogout(site, w, r)
+	if w.Code != http.StatusMethodNotAllowed || len(w.Result().Cookies()) != 0 {
+		t.Errorf("Expected a GET not to log the visitor out, got %d %v", w.Code, w.Result().Cookies())
+	}
+
+	r = httptest.NewRequest(http.MethodPost, LOGOUT_ROUTE, nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handleLogout(site, w, r)
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusSeeOther || len(cookies) != 1 || cookies[0].Name != cookie.Name || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected a POST to end the session, got %d %v", w.Code, cookies)
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"crypto/subtle"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
 const DEBUG = true
@@ -18,6 +19,9 @@ var templates *template.Template
 type AuthCredentialsProvider interface {
 	GetAuthUser() string
 	GetAuthPass() string
+	GetAuthUsers() map[string]string // user to password hash, from an AuthUsersFile
+	GetAuthMode() string
+	GetOidcConfig() *OidcConfig // nil if OpenID Connect isn't available
 }
 
 type BasePageContext struct {
@@ -26,6 +30,13 @@ type BasePageContext struct {
 
 	MetaTitle string
 	SiteTitle string
+
+	SrcSetWidths  []int
+	OutputFormats []OutputFormat
+
+	NoIndex bool // asks search engines not to index the page
+
+	LogoutUrl string // empty unless the page is behind a login page
 }
 
 type IndexPageContext struct {
@@ -37,20 +48,37 @@ type IndexPageContext struct {
 type ImagePageContext struct {
 	*BasePageContext
 
-	Photo      Renderable
+	Photo      *CaptionedPhoto
 	Slug       string
 	AlbumTitle string
+
+	// where the photo sits in the album, Position is 0 if it isn't in the
+	// album's ordering
+	PrevPhoto *CaptionedPhoto
+	NextPhoto *CaptionedPhoto
+	Position  int
+	NumPhotos int
+
+	Exif *PhotoExif // nil unless the site shows EXIF data
+
+	OriginalUrl string // empty if the album doesn't allow downloading originals
 }
 
 type AlbumPageContext struct {
 	*BasePageContext
 
-	AlbumTitle string
+	AlbumTitle       string
+	AlbumDescription template.HTML
+	AlbumDates       string
+	AlbumLocation    string
 
-	Photos                 []Renderable
+	SubAlbums              []*Album
+	Photos                 []*CaptionedPhoto
 	NumImagesToLoadAtStart int
 
 	OgPhoto Renderable // OpenGraph image meta tag
+
+	ZipDownloadUrl string // empty if the album can't be downloaded
 }
 
 func executeTemplateHelper(w io.Writer, templateName string, ctx interface{}) {
@@ -70,18 +98,49 @@ func handleImagePage(slug string, album *Album, w http.ResponseWriter, r *http.R
 	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
 		return
 	}
-	imgUrl := album.site.GetPhotoForKey(album.BucketPrefix + slug)
+	var imgUrl, prevPhoto, nextPhoto *CaptionedPhoto
+	position, numPhotos := 0, 0
+	if albumOrdering, err := album.GetOrderedPhotos(); err == nil {
+		if i := albumOrdering.GetIndexForSlug(slug); i != -1 {
+			imgUrl = albumOrdering.Ordering[i]
+			if i > 0 {
+				prevPhoto = albumOrdering.Ordering[i-1]
+			}
+			if i < len(albumOrdering.Ordering)-1 {
+				nextPhoto = albumOrdering.Ordering[i+1]
+			}
+			position, numPhotos = i+1, len(albumOrdering.Ordering)
+		}
+	}
+	if imgUrl == nil {
+		imgUrl = &CaptionedPhoto{Renderable: album.site.GetPhotoForKey(album.BucketPrefix + slug)}
+	}
+
+	var exif *PhotoExif
+	if album.site.ShowExif {
+		exif = album.GetExifForKey(album.BucketPrefix + slug)
+	}
 
 	ctx := &ImagePageContext{
 		&BasePageContext{
 			album.site.GetCanonicalUrl().String(),
 			album.GetCanonicalUrl().String(),
-			album.MetaTitle,
+			album.GetMetaTitle(),
 			album.site.SiteTitle,
+			album.site.GetSrcSetWidths(),
+			album.site.GetOutputFormats(),
+			album.site.NoIndex,
+			album.GetLogoutUrl(),
 		},
 		imgUrl,
 		slug,
-		album.AlbumTitle,
+		album.GetAlbumTitle(),
+		prevPhoto,
+		nextPhoto,
+		position,
+		numPhotos,
+		exif,
+		album.GetOriginalUrl(slug),
 	}
 	executeTemplateHelper(w, "photo.html", ctx)
 }
@@ -101,13 +160,22 @@ func handleAlbumPage(album *Album, w http.ResponseWriter, r *http.Request) {
 			&BasePageContext{
 				album.site.GetCanonicalUrl().String(),
 				album.GetCanonicalUrl().String(),
-				album.MetaTitle,
+				album.GetMetaTitle(),
 				album.site.SiteTitle,
+				album.site.GetSrcSetWidths(),
+				album.site.GetOutputFormats(),
+				album.site.NoIndex,
+				album.GetLogoutUrl(),
 			},
-			album.AlbumTitle,
+			album.GetAlbumTitle(),
+			album.GetDescription(),
+			album.GetDateRange(),
+			album.GetLocation(),
+			album.GetSubAlbums(),
 			imageUrls,
 			10,
 			nil,
+			album.GetZipDownloadUrl(),
 		}
 		if coverPhoto, err := album.GetCoverPhoto(); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -120,6 +188,47 @@ func handleAlbumPage(album *Album, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serves photos for sites using filesystem storage. Only keys that belong to an
+// album are served, and the album's auth is enforced.
+func handleStorageObject(site *Site, key string, w http.ResponseWriter, r *http.Request) {
+	album, err := site.GetAlbumForKey(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	object, err := site.GetStorage().GetObject(key)
+	if err != nil {
+		if err == ErrObjectNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer object.Close()
+
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Disposition", attachmentDisposition(key))
+	}
+
+	if seeker, ok := object.(io.ReadSeeker); ok {
+		var modTime time.Time
+		if stat, err := site.GetStorage().StatObject(key); err == nil {
+			modTime = stat.LastModified
+		}
+		http.ServeContent(w, r, key, modTime, seeker)
+	} else {
+		io.Copy(w, object)
+	}
+}
+
 func handleAlbumsIndex(site *Site, w http.ResponseWriter, r *http.Request) {
 	ctx := &IndexPageContext{
 		&BasePageContext{
@@ -127,6 +236,10 @@ func handleAlbumsIndex(site *Site, w http.ResponseWriter, r *http.Request) {
 			site.GetCanonicalUrl().String(),
 			site.MetaTitle,
 			site.SiteTitle,
+			site.GetSrcSetWidths(),
+			site.GetOutputFormats(),
+			site.NoIndex,
+			site.GetLogoutUrl(),
 		},
 
 		site.GetAlbumsForIndex(),
@@ -144,6 +257,66 @@ func siteHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	} else {
+		if site.Storage == "filesystem" && strings.HasPrefix(path, FILESYSTEM_STORAGE_ROUTE) {
+			handleStorageObject(site, strings.TrimPrefix(path, FILESYSTEM_STORAGE_ROUTE), w, r)
+			return
+		}
+
+		if strings.HasPrefix(path, API_ROUTE) {
+			handleApi(site, w, r)
+			return
+		}
+
+		if strings.HasPrefix(path, ORIGINAL_ROUTE) {
+			handleOriginal(site, strings.TrimPrefix(path, ORIGINAL_ROUTE), w, r)
+			return
+		}
+
+		if site.ResizingService == "builtin" && strings.HasPrefix(path, BUILTIN_IMAGE_ROUTE) {
+			handleBuiltinImage(site, strings.TrimPrefix(path, BUILTIN_IMAGE_ROUTE), w, r)
+			return
+		}
+
+		if site.HasS3Events() && path == S3_EVENTS_ROUTE {
+			handleS3Events(site, w, r)
+			return
+		}
+
+		if path == LOGIN_ROUTE {
+			handleLogin(site, w, r)
+			return
+		}
+
+		if path == LOGOUT_ROUTE {
+			handleLogout(site, w, r)
+			return
+		}
+
+		if path == OIDC_LOGIN_ROUTE {
+			handleOidcLogin(site, w, r)
+			return
+		}
+
+		if path == OIDC_CALLBACK_ROUTE {
+			handleOidcCallback(site, w, r)
+			return
+		}
+
+		if path == ROBOTS_ROUTE {
+			handleRobotsTxt(site, w, r)
+			return
+		}
+
+		if path == SITEMAP_ROUTE {
+			handleSitemap(site, w, r)
+			return
+		}
+
+		if site.HasAlbumIndex && path == "/"+FEED_SLUG {
+			handleSiteFeed(site, w, r)
+			return
+		}
+
 		if site.HasAlbumIndex && path == "/" {
 			if site.HasAuth() && !checkAndRequireAuth(w, r, site) {
 				return
@@ -167,6 +340,16 @@ func siteHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			if slug == FEED_SLUG {
+				handleAlbumFeed(album, w, r)
+				return
+			}
+
+			if slug == ALBUM_ZIP_SLUG {
+				handleAlbumZip(album, w, r)
+				return
+			}
+
 			if album.ImageExists(slug) {
 				handleImagePage(slug, album, w, r)
 				return
@@ -181,25 +364,76 @@ func siteHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, path+"/", http.StatusMovedPermanently)
 			return
 		}
+		if r.URL.Query().Get("download") == "zip" {
+			handleAlbumZip(album, w, r)
+			return
+		}
 		handleAlbumPage(album, w, r)
 	}
 }
 
+// Whatever is let through is private to the visitor. Shared caches only keep
+// responses to requests with an Authorization header to themselves, and
+// visitors with a session or share cookie don't send one.
+func setPrivateCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "private")
+	w.Header().Add("Vary", "Cookie")
+}
+
 func checkAndRequireAuth(w http.ResponseWriter, r *http.Request, provider AuthCredentialsProvider) bool {
-	if u, p, ok := r.BasicAuth(); !ok || u != provider.GetAuthUser() || subtle.ConstantTimeCompare([]byte(p), []byte(provider.GetAuthPass())) != 1 {
-		w.Header().Set("WWW-Authenticate", `Basic realm="You need a username/password to access this page"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Unauthorized\n"))
+	if album, ok := provider.(*Album); ok && album.HasValidShare(w, r) {
+		setPrivateCacheHeaders(w)
+		return true
+	}
+
+	// basic auth works in every mode, for scripts and API clients, as long as
+	// the provider has credentials. OIDC sites and albums only have them if
+	// they set their own.
+	if u, p, ok := r.BasicAuth(); ok && hasCredentials(provider) && checkCredentials(provider, u, p) {
+		setPrivateCacheHeaders(w)
+		return true
+	}
+
+	if provider.GetAuthMode() == AUTH_MODE_FORM {
+		if getValidSession(r, provider) != nil {
+			setPrivateCacheHeaders(w)
+			return true
+		}
+		renderLoginPage(w, provider, r.URL.RequestURI(), "")
+		return false
+	}
+
+	if provider.GetAuthMode() == AUTH_MODE_OIDC {
+		if getValidSession(r, provider) != nil {
+			setPrivateCacheHeaders(w)
+			return true
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, getOidcLoginUrl(provider, r.URL.RequestURI()), http.StatusFound)
 		return false
 	}
-	return true
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="You need a username/password to access this page"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Unauthorized\n"))
+	return false
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	app = NewApp()
+	app.ReloadOnSignal()
 	templates = template.Must(template.ParseFiles("templates/album.html"))
 
 	http.HandleFunc("/", siteHandler)
+	http.HandleFunc(ADMIN_CACHE_PURGE_ROUTE, handleCachePurge)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 
 	fmt.Printf("Starting server at port %s\n", app.port)
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Sites and albums with AuthMode = oidc send visitors to an OpenID Connect
+// provider to log in. The provider sends them back to OIDC_CALLBACK_ROUTE,
+// where we check their email address against the allowed emails and domains
+// and start a session, like a login page would.
+const OIDC_LOGIN_ROUTE = "/_oidc/login"
+const OIDC_CALLBACK_ROUTE = "/_oidc/callback"
+
+// remembers the state, nonce and PKCE verifier of a login in progress
+const OIDC_STATE_COOKIE = "50mm_oidc"
+const OIDC_STATE_LIFETIME = 10 * time.Minute
+
+const OIDC_HTTP_TIMEOUT = 10 * time.Second
+
+// The provider's discovery document and keys are only fetched once per issuer
+var oidcProviders = make(map[string]*oidc.Provider)
+var oidcProvidersMutex sync.Mutex
+
+type OidcConfig struct {
+	Issuer         string
+	ClientId       string
+	ClientSecret   string
+	AllowedEmails  []string
+	AllowedDomains []string
+
+	TrustUnverifiedEmail bool
+}
+
+type oidcState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Album    string `json:"a"` // empty when logging in to the site
+	Next     string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+func (c *OidcConfig) IsValid() error {
+	if c.Issuer == "" || c.ClientId == "" || c.ClientSecret == "" {
+		return errors.New("AuthMode = oidc requires OidcIssuer, OidcClientId and OidcClientSecret")
+	}
+	if len(c.AllowedEmails) == 0 && len(c.AllowedDomains) == 0 {
+		return errors.New("AuthMode = oidc requires OidcAllowedEmails or OidcAllowedDomains, or nobody could log in")
+	}
+	return nil
+}
+
+func (c *OidcConfig) IsAllowedEmail(email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	i := strings.LastIndex(email, "@")
+	if i <= 0 {
+		return false
+	}
+
+	for _, allowed := range c.AllowedEmails {
+		if strings.ToLower(strings.TrimSpace(allowed)) == email {
+			return true
+		}
+	}
+	for _, allowed := range c.AllowedDomains {
+		if strings.TrimPrefix(strings.ToLower(strings.TrimSpace(allowed)), "@") == email[i+1:] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Site) GetOidcConfig() *OidcConfig {
+	return &OidcConfig{
+		Issuer:         s.OidcIssuer,
+		ClientId:       s.OidcClientId,
+		ClientSecret:   s.OidcClientSecret,
+		AllowedEmails:  s.OidcAllowedEmails,
+		AllowedDomains: s.OidcAllowedDomains,
+
+		TrustUnverifiedEmail: s.OidcTrustUnverifiedEmail,
+	}
+}
+
+// Albums use the site's provider unless they set their own, and the site's
+// allowed emails and domains unless they set either.
+func (a *Album) GetOidcConfig() *OidcConfig {
+	c := a.site.GetOidcConfig()
+	if a.OidcIssuer != "" {
+		c.Issuer = a.OidcIssuer
+	}
+	if a.OidcClientId != "" {
+		c.ClientId = a.OidcClientId
+	}
+	if a.OidcClientSecret != "" {
+		c.ClientSecret = a.OidcClientSecret
+	}
+	if len(a.OidcAllowedEmails) > 0 || len(a.OidcAllowedDomains) > 0 {
+		c.AllowedEmails = a.OidcAllowedEmails
+		c.AllowedDomains = a.OidcAllowedDomains
+	}
+	return c
+}
+
+// both libraries look for the HTTP client they should use in the context
+func getOidcContext() context.Context {
+	client := &http.Client{Timeout: OIDC_HTTP_TIMEOUT}
+	return context.WithValue(oidc.ClientContext(context.Background(), client), oauth2.HTTPClient, client)
+}
+
+func getOidcProvider(issuer string) (*oidc.Provider, error) {
+	oidcProvidersMutex.Lock()
+	defer oidcProvidersMutex.Unlock()
+
+	if provider, ok := oidcProviders[issuer]; ok {
+		return provider, nil
+	}
+
+	// the provider keeps using this context to fetch its keys, so it can't
+	// be the request's
+	provider, err := oidc.NewProvider(getOidcContext(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	oidcProviders[issuer] = provider
+	return provider, nil
+}
+
+func getOauth2Config(site *Site, oidcConfig *OidcConfig, provider *oidc.Provider) *oauth2.Config {
+	redirectUrl := site.GetCanonicalUrl()
+	redirectUrl.Path = OIDC_CALLBACK_ROUTE
+	return &oauth2.Config{
+		ClientID:     oidcConfig.ClientId,
+		ClientSecret: oidcConfig.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectUrl.String(),
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+}
+
+// Where checkAndRequireAuth sends visitors who aren't logged in
+func getOidcLoginUrl(provider AuthCredentialsProvider, next string) string {
+	query := url.Values{}
+	if album, ok := provider.(*Album); ok {
+		query.Set("album", album.Path)
+	}
+	query.Set("next", next)
+	return OIDC_LOGIN_ROUTE + "?" + query.Encode()
+}
+
+// The site or album named by the album parameter of a login
+func getProviderForAlbum(site *Site, albumPath string) (AuthCredentialsProvider, error) {
+	if albumPath == "" {
+		return site, nil
+	}
+	return site.GetAlbumForPath(albumPath)
+}
+
+func randomOidcString() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func signOidcState(site *Site, encodedState string) string {
+	mac := hmac.New(sha256.New, site.getSessionKey())
+	mac.Write([]byte(OIDC_STATE_COOKIE))
+	mac.Write([]byte(encodedState))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sends the visitor to the provider, with the state of the login in a cookie
+// for when they come back.
+func handleOidcLogin(site *Site, w http.ResponseWriter, r *http.Request) {
+	authProvider, err := getProviderForAlbum(site, r.URL.Query().Get("album"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	next := getSafeRedirectPath(r.URL.Query().Get("next"))
+	oidcConfig := authProvider.GetOidcConfig()
+	if authProvider.GetAuthMode() != AUTH_MODE_OIDC {
+		http.Redirect(w, r, next, http.StatusFound)
+		return
+	}
+
+	provider, err := getOidcProvider(oidcConfig.Issuer)
+	if err != nil {
+		log.Printf("Unable to reach OIDC provider %s for site %s. Error: %s\n", oidcConfig.Issuer, site.Domain, err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("Unable to reach the login provider, please try again later\n"))
+		return
+	}
+
+	state := &oidcState{
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     next,
+		Expires:  time.Now().Add(OIDC_STATE_LIFETIME).Unix(),
+	}
+	if album, ok := authProvider.(*Album); ok {
+		state.Album = album.Path
+	}
+	if state.State, err = randomOidcString(); err == nil {
+		state.Nonce, err = randomOidcString()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	payload, err := json.Marshal(state)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	encodedState := base64.RawURLEncoding.EncodeToString(payload)
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Value:    encodedState + "." + signOidcState(site, encodedState),
+		Path:     OIDC_CALLBACK_ROUTE,
+		MaxAge:   int(OIDC_STATE_LIFETIME.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // sent when the provider redirects back
+	})
+
+	w.Header().Set("Cache-Control", "no-store")
+	authCodeUrl := getOauth2Config(site, oidcConfig, provider).AuthCodeURL(state.State, oidc.Nonce(state.Nonce),
+		oauth2.S256ChallengeOption(state.Verifier))
+	http.Redirect(w, r, authCodeUrl, http.StatusFound)
+}
+
+func getOidcStateFromCookie(site *Site, r *http.Request) (*oidcState, error) {
+	cookie, err := r.Cookie(OIDC_STATE_COOKIE)
+	if err != nil {
+		return nil, errors.New("The login took too long, or cookies are disabled")
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signOidcState(site, parts[0]))) {
+		return nil, errors.New("Invalid login state")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	state := &oidcState{}
+	if err := json.Unmarshal(payload, state); err != nil {
+		return nil, err
+	}
+	if time.Now().After(time.Unix(state.Expires, 0)) {
+		return nil, errors.New("The login took too long")
+	}
+	return state, nil
+}
+
+// Checks the provider's answer, and starts a session if the visitor's email
+// address is allowed.
+func handleOidcCallback(site *Site, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	// each login can only come back once
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDC_STATE_COOKIE,
+		Path:     OIDC_CALLBACK_ROUTE,
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	state, err := getOidcStateFromCookie(site, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("Login failed: %s %s\n", errorCode, query.Get("error_description"))))
+		return
+	}
+	if query.Get("state") != state.State {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid login state\n"))
+		return
+	}
+
+	authProvider, err := getProviderForAlbum(site, state.Album)
+	if err != nil || authProvider.GetAuthMode() != AUTH_MODE_OIDC {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("This page doesn't use OpenID Connect to log in anymore\n"))
+		return
+	}
+
+	email, err := verifyOidcLogin(site, authProvider.GetOidcConfig(), state, query.Get("code"))
+	if err != nil {
+		log.Printf("OIDC login failed for site %s. Error: %s\n", site.Domain, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Login failed, please try again\n"))
+		return
+	}
+
+	if !authProvider.GetOidcConfig().IsAllowedEmail(email) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("%s isn't allowed to see this page\n", email)))
+		return
+	}
+
+	if err := startSession(w, r, authProvider, email); err != nil {
+		log.Printf("Unable to start session on site %s. Error: %s\n", site.Domain, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	http.Redirect(w, r, getSafeRedirectPath(state.Next), http.StatusFound)
+}
+
+// Exchanges the code for an ID token and returns the verified email address
+// in it. Tokens without an email_verified claim are rejected, as some
+// providers let users change their email without verifying it, unless the
+// site trusts them with OidcTrustUnverifiedEmail.
+func verifyOidcLogin(site *Site, oidcConfig *OidcConfig, state *oidcState, code string) (string, error) {
+	provider, err := getOidcProvider(oidcConfig.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(getOidcContext(), OIDC_HTTP_TIMEOUT)
+	defer cancel()
+
+	token, err := getOauth2Config(site, oidcConfig, provider).Exchange(ctx, code, oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return "", err
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", errors.New("No id_token in the token response")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientId}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return "", err
+	}
+	if idToken.Nonce != state.Nonce {
+		return "", errors.New("The id_token's nonce doesn't match")
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", err
+	}
+	if claims.Email == "" {
+		return "", errors.New("The id_token has no email")
+	}
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return "", fmt.Errorf("The email %s hasn't been verified", claims.Email)
+	}
+	if claims.EmailVerified == nil && !oidcConfig.TrustUnverifiedEmail {
+		return "", fmt.Errorf("The id_token doesn't say whether the email %s has been verified", claims.Email)
+	}
+	return claims.Email, nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const TEST_OIDC_CLIENT_ID = "50mm-test"
+const TEST_OIDC_CLIENT_SECRET = "client-secret"
+
+// The ID token claims the fake issuer hands out for an authorization code
+type fakeIdTokenClaims struct {
+	Email         string
+	EmailVerified *bool
+	Nonce         string // the nonce of the login when empty
+}
+
+type fakeAuthorization struct {
+	claims        fakeIdTokenClaims
+	nonce         string
+	codeChallenge string
+}
+
+// An OpenID Connect provider with discovery, keys and a token endpoint. The
+// authorization endpoint is never visited, tests hand out codes with
+// authorize instead.
+type fakeOidcIssuer struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+
+	mutex          sync.Mutex
+	authorizations map[string]*fakeAuthorization // by code
+}
+
+func newFakeOidcIssuer(t *testing.T) *fakeOidcIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeOidcIssuer{key: key, authorizations: make(map[string]*fakeAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc("/keys", issuer.handleKeys)
+	mux.HandleFunc("/token", issuer.handleToken)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *fakeOidcIssuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (i *fakeOidcIssuer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (i *fakeOidcIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientId != TEST_OIDC_CLIENT_ID || clientSecret != TEST_OIDC_CLIENT_SECRET {
+		writeOauth2Error(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	i.mutex.Lock()
+	authorization, ok := i.authorizations[r.PostFormValue("code")]
+	delete(i.authorizations, r.PostFormValue("code"))
+	i.mutex.Unlock()
+	if r.PostFormValue("grant_type") != "authorization_code" || !ok {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	// PKCE, the verifier has to match the challenge the login was sent with
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.codeChallenge {
+		writeOauth2Error(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   i.URL,
+		"sub":   "user-" + authorization.claims.Email,
+		"aud":   TEST_OIDC_CLIENT_ID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": authorization.nonce,
+		"email": authorization.claims.Email,
+	}
+	if authorization.claims.Nonce != "" {
+		claims["nonce"] = authorization.claims.Nonce
+	}
+	if authorization.claims.EmailVerified != nil {
+		claims["email_verified"] = *authorization.claims.EmailVerified
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     i.signIdToken(claims),
+	})
+}
+
+func writeOauth2Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (i *fakeOidcIssuer) signIdToken(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Lets the visitor sent to authUrl log in as claims, returns the code the
+// issuer would send them back with.
+func (i *fakeOidcIssuer) authorize(t *testing.T, authUrl *url.URL, claims fakeIdTokenClaims) string {
+	t.Helper()
+
+	query := authUrl.Query()
+	if query.Get("client_id") != TEST_OIDC_CLIENT_ID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Unexpected authorization request %s", authUrl)
+	}
+	if !strings.Contains(query.Get("scope"), "email") {
+		t.Fatalf("Expected the email scope, got '%s'", query.Get("scope"))
+	}
+
+	code, err := randomOidcString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.mutex.Lock()
+	i.authorizations[code] = &fakeAuthorization{claims, query.Get("nonce"), query.Get("code_challenge")}
+	i.mutex.Unlock()
+	return code
+}
+
+func loadTestOidcSite(t *testing.T, issuer *fakeOidcIssuer) *Site {
+	return loadTestSite(t, "AuthMode = oidc\nOidcIssuer = "+issuer.URL+"\n"+
+		"OidcClientId = "+TEST_OIDC_CLIENT_ID+"\nOidcClientSecret = "+TEST_OIDC_CLIENT_SECRET+"\n"+
+		"OidcAllowedEmails = alice@example.com\nOidcAllowedDomains = team.example.com\n"+
+		"[Trips]\nPath = /trips/\nBucketPrefix = trips/\n")
+}
+
+// Starts a login like a visitor sent to the login route would, and returns
+// the state cookie and where the visitor is sent.
+func startTestOidcLogin(t *testing.T, site *Site, next string) (*http.Cookie, *url.URL) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handleOidcLogin(site, w, httptest.NewRequest(http.MethodGet, OIDC_LOGIN_ROUTE+"?next="+url.QueryEscape(next), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the issuer, got %d %s", w.Code, w.Body.String())
+	}
+
+	authUrl, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == OIDC_STATE_COOKIE {
+			return cookie, authUrl
+		}
+	}
+	t.Fatal("Expected a state cookie")
+	return nil, nil
+}
+
+func finishTestOidcLogin(site *Site, stateCookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, OIDC_CALLBACK_ROUTE+"?"+query.Encode(), nil)
+	if stateCookie != nil {
+		r.AddCookie(stateCookie)
+	}
+	w := httptest.NewRecorder()
+	handleOidcCallback(site, w, r)
+	return w
+}
+
+// Logs in as claims, returns the callback's response
+func testOidcLogin(t *testing.T, site *Site, issuer *fakeOidcIssuer, next string, claims fakeIdTokenClaims) *httptest.ResponseRecorder {
+	t.Helper()
+
+	stateCookie, authUrl := startTestOidcLogin(t, site, next)
+	code := issuer.authorize(t, authUrl, claims)
+	return finishTestOidcLogin(site, stateCookie, url.Values{"code": {code}, "state": {authUrl.Query().Get("state")}})
+}
+
+func TestOidcLogin(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	w := testOidcLogin(t, site, issuer, "/trips/?page=2", fakeIdTokenClaims{Email: "alice@example.com", EmailVerified: boolPointer(true)})
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/trips/?page=2" {
+		t.Fatalf("Expected a redirect to /trips/?page=2, got %d %s %s", w.Code, w.Header().Get("Location"), w.Body.String())
+	}
+	sessionCookies := getSessionCookies(w)
+	if len(sessionCookies) != 1 || !sessionCookies[0].HttpOnly || sessionCookies[0].Path != "/" {
+		t.Fatalf("Expected an HttpOnly session cookie for the whole site, got %v", sessionCookies)
+	}
+
+	// the session lets the visitor in
+	r := httptest.NewRequest(http.MethodGet, "/trips/", nil)
+	r.AddCookie(sessionCookies[0])
+	session := getValidSession(r, site)
+	if session == nil || session.User != "alice@example.com" {
+		t.Fatalf("Expected a session for alice@example.com, got %v", session)
+	}
+	if !checkAndRequireAuth(httptest.NewRecorder(), r, site) {
+		t.Error("Expected the session to let the visitor in")
+	}
+
+	// and each login can only come back once
+	var stateCleared bool
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == OIDC_STATE_COOKIE && cookie.MaxAge < 0 {
+			stateCleared = true
+		}
+	}
+	if !stateCleared {
+		t.Error("Expected the state cookie to be removed")
+	}
+}
+
+func TestOidcLoginRequiresSession(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	w := httptest.NewRecorder()
+	if checkAndRequireAuth(w, httptest.NewRequest(http.MethodGet, "/trips/", nil), site) {
+		t.Fatal("Expected visitors without a session to be kept out")
+	}
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), OIDC_LOGIN_ROUTE+"?") {
+		t.Errorf("Expected a redirect to the login, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestOidcAllowedEmails(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	tests := map[string]bool{
+		"alice@example.com":                 true,
+		"Alice@Example.com":                 true,
+		"bob@example.com":                   false,
+		"bob@team.example.com":              true,
+		"carol@TEAM.example.com":            true,
+		"mallory@evilteam.example.com":      false,
+		"mallory@team.example.com.evil.com": false,
+		"team.example.com":                  false,
+	}
+
+	for email, allowed := range tests {
+		w := testOidcLogin(t, site, issuer, "/", fakeIdTokenClaims{Email: email, EmailVerified: boolPointer(true)})
+		if allowed && (w.Code != http.StatusFound || len(getSessionCookies(w)) != 1) {
+			t.Errorf("Expected %s to be let in, got %d %s", email, w.Code, w.Body.String())
+		}
+		if !allowed && (w.Code != http.StatusForbidden || len(getSessionCookies(w)) != 0) {
+			t.Errorf("Expected %s to be kept out, got %d", email, w.Code)
+		}
+	}
+}
+
+func TestOidcUnverifiedEmail(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	tests := map[string]*bool{
+		"unverified":             boolPointer(false),
+		"without email_verified": nil,
+	}
+	for name, verified := range tests {
+		w := testOidcLogin(t, site, issuer, "/", fakeIdTokenClaims{Email: "alice@example.com", EmailVerified: verified})
+		if w.Code != http.StatusForbidden || len(getSessionCookies(w)) != 0 {
+			t.Errorf("Expected an email %s to be kept out, got %d", name, w.Code)
+		}
+	}
+
+	// for providers that never send email_verified
+	site.OidcTrustUnverifiedEmail = true
+	w := testOidcLogin(t, site, issuer, "/", fakeIdTokenClaims{Email: "alice@example.com"})
+	if w.Code != http.StatusFound || len(getSessionCookies(w)) != 1 {
+		t.Errorf("Expected OidcTrustUnverifiedEmail to let in an email without email_verified, got %d %s", w.Code, w.Body.String())
+	}
+	w = testOidcLogin(t, site, issuer, "/", fakeIdTokenClaims{Email: "alice@example.com", EmailVerified: boolPointer(false)})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected OidcTrustUnverifiedEmail to still keep out unverified emails, got %d", w.Code)
+	}
+}
+
+func TestOidcStateMismatch(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	stateCookie, authUrl := startTestOidcLogin(t, site, "/")
+	code := issuer.authorize(t, authUrl, fakeIdTokenClaims{Email: "alice@example.com", EmailVerified: boolPointer(true)})
+
+	// the state of another login, e.g. of an attacker trying to log the
+	// visitor in to their account
+	otherStateCookie, otherAuthUrl := startTestOidcLogin(t, site, "/")
+	w := finishTestOidcLogin(site, stateCookie, url.Values{"code": {code}, "state": {otherAuthUrl.Query().Get("state")}})
+	if w.Code != http.StatusBadRequest || len(getSessionCookies(w)) != 0 {
+		t.Errorf("Expected a state mismatch to be rejected, got %d", w.Code)
+	}
+
+	w = finishTestOidcLogin(site, nil, url.Values{"code": {code}, "state": {authUrl.Query().Get("state")}})
+	if w.Code != http.StatusBadRequest || len(getSessionCookies(w)) != 0 {
+		t.Errorf("Expected a login without the state cookie to be rejected, got %d", w.Code)
+	}
+
+	// a state cookie that wasn't signed by us
+	otherStateCookie.Value = strings.Replace(otherStateCookie.Value, ".", "x.", 1)
+	w = finishTestOidcLogin(site, otherStateCookie, url.Values{"code": {code}, "state": {otherAuthUrl.Query().Get("state")}})
+	if w.Code != http.StatusBadRequest || len(getSessionCookies(w)) != 0 {
+		t.Errorf("Expected a forged state cookie to be rejected, got %d", w.Code)
+	}
+}
+
+func TestOidcNonceMismatch(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	w := testOidcLogin(t, site, issuer, "/", fakeIdTokenClaims{Email: "alice@example.com", EmailVerified: boolPointer(true), Nonce: "the nonce of another login"})
+	if w.Code != http.StatusForbidden || len(getSessionCookies(w)) != 0 {
+		t.Errorf("Expected a nonce mismatch to be rejected, got %d", w.Code)
+	}
+}
+
+func TestOidcProviderError(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	stateCookie, authUrl := startTestOidcLogin(t, site, "/")
+	w := finishTestOidcLogin(site, stateCookie, url.Values{"error": {"access_denied"}, "state": {authUrl.Query().Get("state")}})
+	if w.Code != http.StatusForbidden || len(getSessionCookies(w)) != 0 {
+		t.Errorf("Expected the provider's error to be shown, got %d", w.Code)
+	}
+}
+
+func TestOidcRedirectStaysOnSite(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestOidcSite(t, issuer)
+
+	for _, next := range []string{"//evil.com/", "/\t/evil.com", "https://evil.com/", "/\\evil.com"} {
+		w := testOidcLogin(t, site, issuer, next, fakeIdTokenClaims{Email: "alice@example.com", EmailVerified: boolPointer(true)})
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/" {
+			t.Errorf("Expected next=%q to redirect to /, got %d %s", next, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestOidcAlbumIgnoresSitePassword(t *testing.T) {
+	issuer := newFakeOidcIssuer(t)
+	site := loadTestSite(t, "AuthUser = alice\nAuthPass = secret\n"+
+		"[Trips]\nPath = /trips/\nBucketPrefix = trips/\nInIndex = 0\nAuthMode = oidc\nOidcIssuer = "+issuer.URL+"\n"+
+		"OidcClientId = "+TEST_OIDC_CLIENT_ID+"\nOidcClientSecret = "+TEST_OIDC_CLIENT_SECRET+"\n"+
+		"OidcAllowedEmails = alice@example.com\n")
+	album, err := site.GetAlbumForPath("/trips/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/trips/", nil)
+	r.SetBasicAuth("alice", "secret")
+	if !checkAndRequireAuth(httptest.NewRecorder(), r, site) {
+		t.Error("Expected the site's password to work for the site")
+	}
+	w := httptest.NewRecorder()
+	if checkAndRequireAuth(w, r, album) {
+		t.Error("Expected the site's password not to work for an album behind OIDC")
+	}
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected a redirect to the login, got %d", w.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Albums with AllowOriginals link each photo page to '/_original/<key>', which
+// sends visitors on to a download of the full resolution file.
+const ORIGINAL_ROUTE = "/_original/"
+
+// The URL visitors can download the original of a photo from, empty if the
+// album doesn't allow it.
+func (a *Album) GetOriginalUrl(slug string) string {
+	if !a.AllowOriginals {
+		return ""
+	}
+	u := a.site.GetCanonicalUrl()
+	u.Path = ORIGINAL_ROUTE + strings.TrimLeft(a.BucketPrefix+slug, "/")
+	return u.String()
+}
+
+// Checks the visitor may see the photo and redirects to a short lived download
+// URL of the original, whatever the site's ResizingService.
+func handleOriginal(site *Site, key string, w http.ResponseWriter, r *http.Request) {
+	album, err := site.GetAlbumForKey(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	// only photos shown in the album, so ordering files etc stay private
+	if !album.AllowOriginals || !album.ImageExists(path.Base(key)) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+		return
+	}
+
+	downloadUrl, err := site.GetStorage().GetObjectDownloadUrl(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, downloadUrl, http.StatusFound)
+}
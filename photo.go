@@ -8,10 +8,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
-	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/globocom/gothumbor"
 )
@@ -41,14 +38,20 @@ type ThumborCloudfront struct {
 	AWSCloudfrontPrivateKey *rsa.PrivateKey //required for URL signing
 }
 
-type S3Photo struct {
-	Key        string
-	BucketName string
-	awsSession *session.Session
+// resized by 50mm itself, see resize.go. BaseUrl is the site's URL.
+type BuiltinRescaledPhoto struct {
+	*RescaledPhoto
+	Secret string
+}
+
+// served straight from storage, e.g: presigned S3 URLs
+type StoragePhoto struct {
+	Key     string
+	storage Storage
 }
 
 type ImageProxy struct {
-	*S3Photo
+	*StoragePhoto
 	ImageProxy string
 }
 
@@ -56,6 +59,36 @@ type Renderable interface {
 	Slug() string
 	GetPhotoForWidth(int) string
 	GetThumbnailForWidthAndHeight(int, int) string
+	GetSrcSetForWidths([]int) string // for the srcset attribute of an img tag
+	// for the srcset attribute of a picture's source tag, empty if the photo
+	// can't be served in the format
+	GetSrcSetForWidthsAndFormat([]int, OutputFormat) string
+}
+
+// An image format resizing services can convert photos to, see the
+// OutputFormats site option.
+type OutputFormat string
+
+var OUTPUT_FORMAT_MIME_TYPES = map[OutputFormat]string{
+	"avif": "image/avif",
+	"webp": "image/webp",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+func (f OutputFormat) MimeType() string {
+	return OUTPUT_FORMAT_MIME_TYPES[f]
+}
+
+// builds a srcset out of the photo's URL for each of the widths
+func srcSetForWidths(getPhotoForWidth func(int) string, widths []int) string {
+	candidates := make([]string, 0, len(widths))
+	for _, w := range widths {
+		if photoUrl := getPhotoForWidth(w); photoUrl != "" {
+			candidates = append(candidates, fmt.Sprintf("%s %dw", photoUrl, w))
+		}
+	}
+	return strings.Join(candidates, ", ")
 }
 
 func (p *RescaledPhoto) Slug() string {
@@ -63,7 +96,7 @@ func (p *RescaledPhoto) Slug() string {
 	return parts[len(parts)-1]
 }
 
-func (p *ImgixRescaledPhoto) GetPhotoForWidth(w int) string {
+func (p *ImgixRescaledPhoto) getPhotoForWidthAndFormat(w int, format OutputFormat) string {
 	keyPathUrl, err := url.Parse(p.Key)
 	if err != nil {
 		log.Print(err)
@@ -73,11 +106,20 @@ func (p *ImgixRescaledPhoto) GetPhotoForWidth(w int) string {
 	fullUrl := p.BaseUrl.ResolveReference(keyPathUrl)
 	queryValues := fullUrl.Query()
 	queryValues.Add("w", fmt.Sprint(w))
+	if format == "jpeg" {
+		queryValues.Add("fm", "jpg")
+	} else if format != "" {
+		queryValues.Add("fm", string(format))
+	}
 	fullUrl.RawQuery = queryValues.Encode()
 
 	return fullUrl.String()
 }
 
+func (p *ImgixRescaledPhoto) GetPhotoForWidth(w int) string {
+	return p.getPhotoForWidthAndFormat(w, "")
+}
+
 func (p *ImgixRescaledPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	keyPathUrl, err := url.Parse(p.Key)
 	if err != nil {
@@ -97,8 +139,52 @@ func (p *ImgixRescaledPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	return fullUrl.String()
 }
 
-func (p *ThumborRaw) GetPhotoForWidth(w int) string {
-	thumborOptions := gothumbor.ThumborOptions{Width: w, Smart: true}
+func (p *ImgixRescaledPhoto) GetSrcSetForWidths(widths []int) string {
+	return srcSetForWidths(p.GetPhotoForWidth, widths)
+}
+
+func (p *ImgixRescaledPhoto) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	return srcSetForWidths(func(w int) string { return p.getPhotoForWidthAndFormat(w, format) }, widths)
+}
+
+func (p *BuiltinRescaledPhoto) getUrlForDimensions(w, h int) string {
+	imagePath := fmt.Sprintf("%dx%d/%s", w, h, strings.TrimLeft(p.Key, "/"))
+
+	fullUrl := *p.BaseUrl
+	fullUrl.Path = BUILTIN_IMAGE_ROUTE + imagePath
+	fullUrl.RawQuery = url.Values{"s": {signBuiltinImagePath(p.Secret, imagePath)}}.Encode()
+
+	return fullUrl.String()
+}
+
+func (p *BuiltinRescaledPhoto) GetPhotoForWidth(w int) string {
+	return p.getUrlForDimensions(w, 0)
+}
+
+func (p *BuiltinRescaledPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
+	return p.getUrlForDimensions(w, h)
+}
+
+func (p *BuiltinRescaledPhoto) GetSrcSetForWidths(widths []int) string {
+	return srcSetForWidths(p.GetPhotoForWidth, widths)
+}
+
+// we keep the format of the original, see resizeStorageObject
+func (p *BuiltinRescaledPhoto) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	return ""
+}
+
+// thumbor converts images with the format filter, an empty format keeps the
+// format of the original.
+func thumborFiltersForFormat(format OutputFormat) []string {
+	if format == "" {
+		return nil
+	}
+	return []string{fmt.Sprintf("format(%s)", format)}
+}
+
+func (p *ThumborRaw) getPhotoForWidthAndFormat(w int, format OutputFormat) string {
+	thumborOptions := gothumbor.ThumborOptions{Width: w, Smart: true, Filters: thumborFiltersForFormat(format)}
 	thumborPath, err := gothumbor.GetCryptedThumborPath(p.Secret, p.Key, thumborOptions)
 	if err != nil {
 		log.Print(err)
@@ -111,6 +197,10 @@ func (p *ThumborRaw) GetPhotoForWidth(w int) string {
 	return fullUrl.String()
 }
 
+func (p *ThumborRaw) GetPhotoForWidth(w int) string {
+	return p.getPhotoForWidthAndFormat(w, "")
+}
+
 func (p *ThumborRaw) GetThumbnailForWidthAndHeight(w, h int) string {
 	thumborOptions := gothumbor.ThumborOptions{Width: w, Height: h, Smart: true}
 	thumborPath, err := gothumbor.GetCryptedThumborPath(p.Secret, p.Key, thumborOptions)
@@ -125,6 +215,14 @@ func (p *ThumborRaw) GetThumbnailForWidthAndHeight(w, h int) string {
 	return fullUrl.String()
 }
 
+func (p *ThumborRaw) GetSrcSetForWidths(widths []int) string {
+	return srcSetForWidths(p.GetPhotoForWidth, widths)
+}
+
+func (p *ThumborRaw) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	return srcSetForWidths(func(w int) string { return p.getPhotoForWidthAndFormat(w, format) }, widths)
+}
+
 func (p *ThumborCloudfront) SignCloudfrontURL(path string) string {
 
 	parsedPath, err := url.Parse(path)
@@ -144,9 +242,9 @@ func (p *ThumborCloudfront) SignCloudfrontURL(path string) string {
 	return signedURL
 }
 
-func (p *ThumborCloudfront) GetPhotoForWidth(w int) string {
+func (p *ThumborCloudfront) getPhotoForWidthAndFormat(w int, format OutputFormat) string {
 	// get thumbor path without signing
-	thumborOptions := gothumbor.ThumborOptions{Width: w, Smart: true}
+	thumborOptions := gothumbor.ThumborOptions{Width: w, Smart: true, Filters: thumborFiltersForFormat(format)}
 	thumborPath, err := gothumbor.GetThumborPath(p.Key, thumborOptions)
 	if err != nil {
 		log.Print(err)
@@ -156,6 +254,10 @@ func (p *ThumborCloudfront) GetPhotoForWidth(w int) string {
 	return p.SignCloudfrontURL(thumborPath)
 }
 
+func (p *ThumborCloudfront) GetPhotoForWidth(w int) string {
+	return p.getPhotoForWidthAndFormat(w, "")
+}
+
 func (p *ThumborCloudfront) GetThumbnailForWidthAndHeight(w, h int) string {
 	thumborOptions := gothumbor.ThumborOptions{Width: w, Height: h, Smart: true}
 	thumborPath, err := gothumbor.GetThumborPath(p.Key, thumborOptions)
@@ -167,59 +269,106 @@ func (p *ThumborCloudfront) GetThumbnailForWidthAndHeight(w, h int) string {
 	return p.SignCloudfrontURL(thumborPath)
 }
 
-func (p *S3Photo) Slug() string {
+func (p *ThumborCloudfront) GetSrcSetForWidths(widths []int) string {
+	return srcSetForWidths(p.GetPhotoForWidth, widths)
+}
+
+func (p *ThumborCloudfront) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	return srcSetForWidths(func(w int) string { return p.getPhotoForWidthAndFormat(w, format) }, widths)
+}
+
+func (p *StoragePhoto) Slug() string {
 	parts := strings.Split(p.Key, "/")
 	return parts[len(parts)-1]
 }
 
-func (p *S3Photo) GetPhotoForWidth(w int) string {
-	req, _ := s3.New(p.awsSession).GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(p.BucketName),
-		Key:    aws.String(p.Key),
-	})
-
-	signedUrl, err := req.Presign(24 * time.Hour)
+func (p *StoragePhoto) GetPhotoForWidth(w int) string {
+	objectUrl, err := p.storage.GetObjectUrl(p.Key)
 	if err != nil {
-		log.Printf("Unable to sign URL for S3Photo. Error: %s\n", err.Error())
+		log.Printf("Unable to get URL for StoragePhoto. Error: %s\n", err.Error())
 		return ""
 	}
 
-	return signedUrl
+	return objectUrl
 }
 
-func (p *S3Photo) GetThumbnailForWidthAndHeight(w, h int) string {
+func (p *StoragePhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	return p.GetPhotoForWidth(w)
 }
 
+// originals are the same whatever the width, so there's only one candidate
+func (p *StoragePhoto) GetSrcSetForWidths(widths []int) string {
+	return p.GetPhotoForWidth(0)
+}
+
+func (p *StoragePhoto) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	return ""
+}
+
 func (p *ImageProxy) Slug() string {
 	parts := strings.Split(p.Key, "/")
 	return parts[len(parts)-1]
 }
 
-func (p *ImageProxy) GetPhotoForWidth(w int) string {
-	req, _ := s3.New(p.awsSession).GetObjectRequest(&s3.GetObjectInput{
-		Bucket: aws.String(p.BucketName),
-		Key:    aws.String(p.Key),
-	})
-
-	signedUrl, err := req.Presign(24 * time.Hour)
-	if err != nil {
-		log.Printf("Unable to sign URL for S3Photo. Error: %s\n", err.Error())
+func (p *ImageProxy) getPhotoForWidthAndFormat(w int, format OutputFormat) string {
+	objectUrl := p.StoragePhoto.GetPhotoForWidth(w)
+	if objectUrl == "" {
 		return ""
 	}
-	queryUrl, err := url.Parse(signedUrl)
-	if err != nil {
-		log.Printf("Unable to sign URL %s for S3Photo. Error: %s\n", queryUrl.String(), err.Error())
-		return ""
+
+	options := fmt.Sprintf("%dx", w)
+	if format != "" {
+		options += "," + string(format)
 	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimRight(p.ImageProxy, "/"), options, objectUrl)
+}
 
-	return fmt.Sprintf("%s/%dx/%s", strings.TrimRight(p.ImageProxy, "/"), w, signedUrl)
+func (p *ImageProxy) GetPhotoForWidth(w int) string {
+	return p.getPhotoForWidthAndFormat(w, "")
 }
 
 func (p *ImageProxy) GetThumbnailForWidthAndHeight(w, h int) string {
 	return p.GetPhotoForWidth(w)
 }
 
+func (p *ImageProxy) GetSrcSetForWidths(widths []int) string {
+	return srcSetForWidths(p.GetPhotoForWidth, widths)
+}
+
+// imageproxy can only encode JPEG and PNG (and TIFF, which browsers don't show)
+func (p *ImageProxy) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	if format != "jpeg" && format != "png" {
+		return ""
+	}
+	return srcSetForWidths(func(w int) string { return p.getPhotoForWidthAndFormat(w, format) }, widths)
+}
+
+// A photo along with the details set for it in the album's ordering file
+type CaptionedPhoto struct {
+	Renderable
+	Title   string
+	Caption string
+	Alt     string
+}
+
+// The title if there's one, the file name otherwise
+func (p *CaptionedPhoto) GetDisplayTitle() string {
+	if p.Title != "" {
+		return p.Title
+	}
+	return p.Slug()
+}
+
+func (p *CaptionedPhoto) GetAltText() string {
+	if p.Alt != "" {
+		return p.Alt
+	}
+	if p.Title != "" {
+		return p.Title
+	}
+	return p.Caption
+}
+
 /*
 Used when we can't get the photo required, and have to return something, for example in methods used by templates
 */
@@ -237,3 +386,11 @@ func (p *ErrorPhoto) GetPhotoForWidth(w int) string {
 func (p *ErrorPhoto) GetThumbnailForWidthAndHeight(w, h int) string {
 	return ""
 }
+
+func (p *ErrorPhoto) GetSrcSetForWidths(widths []int) string {
+	return ""
+}
+
+func (p *ErrorPhoto) GetSrcSetForWidthsAndFormat(widths []int, format OutputFormat) string {
+	return ""
+}
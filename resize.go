@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// URL prefix the builtin resizing service serves images under, followed by
+// '<width>x<height>/<key>'. A height of 0 keeps the aspect ratio of the original.
+const BUILTIN_IMAGE_ROUTE = "/_img/"
+
+const BUILTIN_IMAGE_MAX_DIMENSION = 4000
+const BUILTIN_IMAGE_JPEG_QUALITY = 85
+
+// Originals with more pixels than this aren't decoded, a decoded photo takes
+// about 4 bytes per pixel.
+const BUILTIN_IMAGE_MAX_PIXELS = 100 * 1000 * 1000
+
+// Originals larger than this aren't read, whatever their header says
+const BUILTIN_IMAGE_MAX_BYTES = 200 * 1024 * 1024
+
+// Part of the name of every cached image, bump it when resizing changes how
+// images come out so the cache doesn't keep serving the old ones.
+const BUILTIN_IMAGE_CACHE_VERSION = 2
+const DEFAULT_IMAGE_CACHE_SIZE_MB = 500
+
+// decoding and resizing large photos is memory hungry, so we only do as many
+// at a time as we have CPUs. Originals are fetched before taking a slot, so
+// slow storage doesn't hold them up.
+var resizeSemaphore = make(chan struct{}, runtime.NumCPU())
+
+var imageCaches = make(map[string]*ImageCache)
+var imageCachesMutex sync.Mutex
+
+// Signs the '<width>x<height>/<key>' part of a builtin image URL, so that
+// nobody can make us resize photos to sizes we never asked for.
+func signBuiltinImagePath(secret string, imagePath string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(imagePath))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func handleBuiltinImage(site *Site, imagePath string, w http.ResponseWriter, r *http.Request) {
+	signature := r.URL.Query().Get("s")
+	if !hmac.Equal([]byte(signature), []byte(signBuiltinImagePath(site.ResizingServiceSecret, imagePath))) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Invalid signature\n"))
+		return
+	}
+
+	i := strings.Index(imagePath, "/")
+	if i == -1 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+		return
+	}
+	width, height, err := parseImageDimensions(imagePath[:i])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	key := imagePath[i+1:]
+
+	album, err := site.GetAlbumForKey(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	stat, err := site.GetStorage().StatObject(key)
+	if err != nil {
+		if err == ErrObjectNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// the name changes whenever the original does, so stale entries just age
+	// out of the cache.
+	nameHash := sha256.Sum256([]byte(fmt.Sprintf("%d|%s|%s|%dx%d|%d|%d", BUILTIN_IMAGE_CACHE_VERSION,
+		site.Domain, key, width, height, stat.LastModified.UnixNano(), stat.Size)))
+	cacheName := hex.EncodeToString(nameHash[:])
+
+	data, ok := site.imageCache.Get(cacheName)
+	if !ok {
+		data, err = resizeStorageObject(site.GetStorage(), key, width, height)
+		if err != nil {
+			log.Printf("Unable to resize %s for site %s. Error: %s\n", key, site.Domain, err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		site.imageCache.Put(cacheName, data)
+	}
+
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	http.ServeContent(w, r, "", stat.LastModified, bytes.NewReader(data))
+}
+
+func parseImageDimensions(dimensions string) (int, int, error) {
+	parts := strings.Split(dimensions, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid image dimensions '%s'", dimensions)
+	}
+
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width <= 0 || width > BUILTIN_IMAGE_MAX_DIMENSION {
+		return 0, 0, fmt.Errorf("Invalid image width '%s'", parts[0])
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height < 0 || height > BUILTIN_IMAGE_MAX_DIMENSION {
+		return 0, 0, fmt.Errorf("Invalid image height '%s'", parts[1])
+	}
+	return width, height, nil
+}
+
+// Fetches the original from storage, turns it the way its EXIF Orientation
+// says and scales it to width. If height is set the photo is scaled to cover
+// width x height and the center is cropped out. We never scale photos up.
+func resizeStorageObject(storage Storage, key string, width, height int) ([]byte, error) {
+	object, err := storage.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	// the header tells us the size without reading the whole image, the
+	// bytes it was read from are kept for decoding
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(object, &header))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > BUILTIN_IMAGE_MAX_PIXELS {
+		return nil, fmt.Errorf("Image %s is %dx%d, which is more than %d pixels", key, config.Width, config.Height,
+			BUILTIN_IMAGE_MAX_PIXELS)
+	}
+
+	rest, err := ioutil.ReadAll(io.LimitReader(object, BUILTIN_IMAGE_MAX_BYTES-int64(header.Len())+1))
+	if err != nil {
+		return nil, err
+	}
+	original := append(header.Bytes(), rest...)
+	if len(original) > BUILTIN_IMAGE_MAX_BYTES {
+		return nil, fmt.Errorf("Image %s is more than %d bytes", key, BUILTIN_IMAGE_MAX_BYTES)
+	}
+
+	resizeSemaphore <- struct{}{}
+	defer func() { <-resizeSemaphore }()
+
+	src, format, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	src = applyExifOrientation(src, ReadExifOrientation(original))
+
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW == 0 || srcH == 0 {
+		return nil, fmt.Errorf("Image %s is empty", key)
+	}
+
+	if height == 0 {
+		if width > srcW {
+			width = srcW
+		}
+		height = srcH * width / srcW
+		if height == 0 {
+			height = 1
+		}
+	} else {
+		// shrink the requested box until it fits in the original
+		if width > srcW {
+			height, width = height*srcW/width, srcW
+		}
+		if height > srcH {
+			width, height = width*srcH/height, srcH
+		}
+		if width == 0 || height == 0 {
+			width, height = 1, 1
+		}
+
+		// the largest part of the original with the aspect ratio of the box
+		cropW, cropH := srcW, srcW*height/width
+		if cropH > srcH {
+			cropW, cropH = srcH*width/height, srcH
+		}
+		x0 := bounds.Min.X + (srcW-cropW)/2
+		y0 := bounds.Min.Y + (srcH-cropH)/2
+		bounds = image.Rect(x0, y0, x0+cropW, y0+cropH)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: BUILTIN_IMAGE_JPEG_QUALITY})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Turns a photo the way an EXIF Orientation tag says it should be shown.
+// Orientations 5 to 8 swap width and height. Every pixel maps onto exactly one
+// pixel, so nearest neighbour doesn't lose anything.
+func applyExifOrientation(src image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := float64(bounds.Dx()), float64(bounds.Dy())
+	// maps source coordinates, relative to bounds.Min, to the turned image
+	var m f64.Aff3
+	switch orientation {
+	case 2: // flipped horizontally
+		m = f64.Aff3{-1, 0, w, 0, 1, 0}
+	case 3: // turned 180°
+		m = f64.Aff3{-1, 0, w, 0, -1, h}
+	case 4: // flipped vertically
+		m = f64.Aff3{1, 0, 0, 0, -1, h}
+	case 5: // flipped along the top left to bottom right diagonal
+		m = f64.Aff3{0, 1, 0, 1, 0, 0}
+	case 6: // needs turning 90° clockwise
+		m = f64.Aff3{0, -1, h, 1, 0, 0}
+	case 7: // flipped along the top right to bottom left diagonal
+		m = f64.Aff3{0, -1, h, -1, 0, w}
+	case 8: // needs turning 90° counter clockwise
+		m = f64.Aff3{0, 1, 0, -1, 0, w}
+	}
+	m[2] -= m[0]*float64(bounds.Min.X) + m[1]*float64(bounds.Min.Y)
+	m[5] -= m[3]*float64(bounds.Min.X) + m[4]*float64(bounds.Min.Y)
+
+	dstW, dstH := bounds.Dx(), bounds.Dy()
+	if orientation >= 5 {
+		dstW, dstH = dstH, dstW
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	draw.NearestNeighbor.Transform(dst, m, src, bounds, draw.Src, nil)
+	return dst
+}
+
+// A size bounded cache of resized images on disk. When it grows past maxBytes
+// the least recently used files are removed.
+type ImageCache struct {
+	dir       string
+	maxBytes  int64
+	usedBytes int64
+
+	mutex sync.Mutex
+}
+
+// Caches are shared by every site configured with the same directory, so that
+// reloading configs doesn't lose track of what's on disk.
+func GetImageCache(dir string, maxBytes int64) (*ImageCache, error) {
+	imageCachesMutex.Lock()
+	defer imageCachesMutex.Unlock()
+
+	if cache, ok := imageCaches[dir]; ok {
+		cache.mutex.Lock()
+		cache.maxBytes = maxBytes
+		cache.mutex.Unlock()
+		return cache, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	cache := &ImageCache{dir: dir, maxBytes: maxBytes}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			cache.usedBytes += info.Size()
+		}
+	}
+
+	imageCaches[dir] = cache
+	return cache, nil
+}
+
+// Reads without the mutex, files only ever appear whole (see Put) and one
+// that's evicted while we read it is just a miss.
+func (c *ImageCache) Get(name string) ([]byte, bool) {
+	path := filepath.Join(c.dir, name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	// the modification time tracks when a file was last used
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+func (c *ImageCache) Put(name string, data []byte) {
+	c.mutex.Lock()
+	maxBytes := c.maxBytes
+	c.mutex.Unlock()
+
+	if int64(len(data)) > maxBytes {
+		return
+	}
+
+	// write to a temporary file first, so readers never see half a file
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		log.Printf("Unable to write to image cache %s. Error: %s\n", c.dir, err.Error())
+		return
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(c.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Unable to write to image cache %s. Error: %s\n", c.dir, err.Error())
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.usedBytes += int64(len(data))
+	if c.usedBytes > c.maxBytes {
+		c.evict()
+	}
+}
+
+// Removes the least recently used files until we're at 90% of maxBytes,
+// callers must hold the mutex.
+func (c *ImageCache) evict() {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		log.Printf("Unable to read image cache %s. Error: %s\n", c.dir, err.Error())
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	c.usedBytes = 0
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			c.usedBytes += info.Size()
+		}
+	}
+
+	target := c.maxBytes / 10 * 9
+	for _, info := range infos {
+		if c.usedBytes <= target {
+			break
+		}
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, info.Name())); err == nil {
+			c.usedBytes -= info.Size()
+		}
+	}
+}
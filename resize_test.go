@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApplyExifOrientation(t *testing.T) {
+	// A B C
+	// D E F
+	src := image.NewGray(image.Rect(10, 20, 13, 22))
+	for i, c := range "ABCDEF" {
+		src.SetGray(10+i%3, 20+i/3, color.Gray{uint8(c)})
+	}
+
+	expected := map[int]string{
+		0: "ABC/DEF", // no orientation
+		1: "ABC/DEF",
+		2: "CBA/FED",
+		3: "FED/CBA",
+		4: "DEF/ABC",
+		5: "AD/BE/CF",
+		6: "DA/EB/FC",
+		7: "FC/EB/DA",
+		8: "CF/BE/AD",
+		9: "ABC/DEF", // not an orientation
+	}
+	for orientation, pixels := range expected {
+		img := applyExifOrientation(src, orientation)
+		bounds := img.Bounds()
+
+		var buf bytes.Buffer
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			if y > bounds.Min.Y {
+				buf.WriteByte('/')
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, _, _, _ := img.At(x, y).RGBA()
+				buf.WriteByte(byte(r >> 8))
+			}
+		}
+		if buf.String() != pixels {
+			t.Errorf("Orientation %d: expected %s, got %s", orientation, pixels, buf.String())
+		}
+	}
+}
+
+func TestImageCacheEviction(t *testing.T) {
+	cache, err := GetImageCache(t.TempDir(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		cache.Put(fmt.Sprintf("image-%d", i), bytes.Repeat([]byte{byte(i)}, 100))
+	}
+	if data, ok := cache.Get("image-19"); !ok || len(data) != 100 || data[0] != 19 {
+		t.Error("Expected the last image to be cached")
+	}
+	if _, ok := cache.Get("image-0"); ok {
+		t.Error("Expected the first image to be evicted")
+	}
+
+	infos, err := ioutil.ReadDir(cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, info := range infos {
+		size += info.Size()
+	}
+	if size > 1000 {
+		t.Errorf("Expected the cache to stay under 1000 bytes, it's %d", size)
+	}
+
+	cache.Put("too-big", make([]byte, 1001))
+	if _, ok := cache.Get("too-big"); ok {
+		t.Error("Expected images larger than the cache not to be cached")
+	}
+}
+
+// run with -race
+func TestImageCacheConcurrentUse(t *testing.T) {
+	cache, err := GetImageCache(filepath.Join(t.TempDir(), "images"), 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("image-%d", (i+j)%30)
+				if data, ok := cache.Get(name); ok && len(data) != 100 {
+					t.Errorf("Got half of %s", name)
+					return
+				}
+				cache.Put(name, bytes.Repeat([]byte{byte(j)}, 100))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Serves one object from a reader, and counts how much of it was read
+type readerStorage struct {
+	Storage
+
+	object    io.Reader
+	bytesRead int64
+}
+
+func (s *readerStorage) GetObject(key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(s), nil
+}
+
+func (s *readerStorage) Read(p []byte) (int, error) {
+	n, err := s.object.Read(p)
+	atomic.AddInt64(&s.bytesRead, int64(n))
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeStorageObject(t *testing.T) {
+	storage := &readerStorage{object: bytes.NewReader(encodeTestPNG(t, 400, 300))}
+	data, err := resizeStorageObject(storage, "photo.png", 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "png" || config.Width != 200 || config.Height != 150 {
+		t.Errorf("Expected a 200x150 png, got %s %dx%d %v", format, config.Width, config.Height, err)
+	}
+}
+
+func TestResizeStorageObjectTooManyPixels(t *testing.T) {
+	// a header that says 20000x20000, followed by endless image data
+	ihdr := []byte("IHDR\x00\x00\x00\x00\x00\x00\x00\x00\x08\x00\x00\x00\x00") // 8 bit grayscale
+	binary.BigEndian.PutUint32(ihdr[4:], 20000)
+	binary.BigEndian.PutUint32(ihdr[8:], 20000)
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(ihdr))
+	header := append(append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), ihdr...), checksum...)
+	storage := &readerStorage{object: io.MultiReader(bytes.NewReader(header), zeroReader{})}
+
+	// the original is checked before waiting for a slot, so this doesn't block
+	// while every slot is busy
+	for i := 0; i < cap(resizeSemaphore); i++ {
+		resizeSemaphore <- struct{}{}
+	}
+	defer func() {
+		for i := 0; i < cap(resizeSemaphore); i++ {
+			<-resizeSemaphore
+		}
+	}()
+
+	done := make(chan error)
+	go func() {
+		_, err := resizeStorageObject(storage, "huge.png", 200, 0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "pixels") {
+			t.Errorf("Expected the original to be refused for its size, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the original to be refused without waiting for a resize slot")
+	}
+
+	if bytesRead := atomic.LoadInt64(&storage.bytesRead); bytesRead > 64*1024 {
+		t.Errorf("Expected only the header to be read, read %d bytes", bytesRead)
+	}
+}
+
+func TestResizeStorageObjectTooManyBytes(t *testing.T) {
+	// a small image with endless junk after it
+	storage := &readerStorage{object: io.MultiReader(bytes.NewReader(encodeTestPNG(t, 40, 30)), zeroReader{})}
+	if _, err := resizeStorageObject(storage, "padded.png", 20, 0); err == nil || !strings.Contains(err.Error(), "bytes") {
+		t.Errorf("Expected the original to be refused for its size, got %v", err)
+	}
+	if bytesRead := atomic.LoadInt64(&storage.bytesRead); bytesRead > BUILTIN_IMAGE_MAX_BYTES+64*1024 {
+		t.Errorf("Expected at most %d bytes to be read, read %d", BUILTIN_IMAGE_MAX_BYTES, bytesRead)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How visitors prove they may see a site or album, set with AuthMode on the
+// site or the album.
+const (
+	AUTH_MODE_BASIC = "basic" // HTTP basic auth, the default
+	AUTH_MODE_FORM  = "form"  // a login page and a session cookie, see login.go
+	AUTH_MODE_OIDC  = "oidc"  // an OpenID Connect provider and a session cookie, see oidc.go
+)
+
+// Sessions are kept in a signed cookie rather than on the server. Without a
+// SessionSecret they're signed with a key that only lives in memory, so
+// restarting 50mm logs everyone out.
+const SESSION_COOKIE_PREFIX = "50mm_session_"
+const DEFAULT_SESSION_LIFETIME = 7 * 24 * time.Hour
+const MIN_SESSION_SECRET_LENGTH = 16
+
+var fallbackSessionKey = newFallbackSessionKey()
+
+func newFallbackSessionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func IsValidAuthMode(authMode string) bool {
+	switch authMode {
+	case AUTH_MODE_BASIC, AUTH_MODE_FORM, AUTH_MODE_OIDC:
+		return true
+	}
+	return false
+}
+
+type Session struct {
+	Scope   string `json:"s"` // '/' for the site, or the path of the album
+	User    string `json:"u"`
+	Expires int64  `json:"e"` // unix time
+}
+
+func (s *Site) GetSessionLifetime() time.Duration {
+	if s.SessionLifetime > 0 {
+		return s.SessionLifetime
+	}
+	return DEFAULT_SESSION_LIFETIME
+}
+
+func (s *Site) getSessionKey() []byte {
+	if s.SessionSecret != "" {
+		return []byte(s.SessionSecret)
+	}
+	return fallbackSessionKey
+}
+
+// The site behind the provider, nil for the admin endpoints which only do
+// basic auth.
+func getSiteForProvider(provider AuthCredentialsProvider) *Site {
+	switch p := provider.(type) {
+	case *Site:
+		return p
+	case *Album:
+		return p.site
+	}
+	return nil
+}
+
+// Albums that use the site's credentials share the site's session, albums
+// with their own get one for their path, which their child albums also use.
+func getSessionScope(provider AuthCredentialsProvider) string {
+	if album, ok := provider.(*Album); ok && album.HasOwnAuth() {
+		return album.Path
+	}
+	return "/"
+}
+
+// Sessions are signed along with the credentials they were created for, so a
+// session only works for sites and albums with the same credentials, and
+// changing the credentials logs everyone out.
+func getCredentialsFingerprint(provider AuthCredentialsProvider) []byte {
+	hash := sha256.New()
+	for _, s := range []string{provider.GetAuthMode(), provider.GetAuthUser(), provider.GetAuthPass()} {
+		hash.Write([]byte(s))
+		hash.Write([]byte{0})
+	}
+
+	authUsers := provider.GetAuthUsers()
+	users := make([]string, 0, len(authUsers))
+	for user := range authUsers {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		hash.Write([]byte(user + ":" + authUsers[user]))
+		hash.Write([]byte{0})
+	}
+
+	if oidcConfig := provider.GetOidcConfig(); oidcConfig != nil && provider.GetAuthMode() == AUTH_MODE_OIDC {
+		for _, s := range []string{oidcConfig.Issuer, oidcConfig.ClientId,
+			strings.Join(oidcConfig.AllowedEmails, ","), strings.Join(oidcConfig.AllowedDomains, ",")} {
+			hash.Write([]byte(s))
+			hash.Write([]byte{0})
+		}
+	}
+	return hash.Sum(nil)
+}
+
+func signSessionPayload(site *Site, provider AuthCredentialsProvider, encodedPayload string) string {
+	mac := hmac.New(sha256.New, site.getSessionKey())
+	mac.Write(getCredentialsFingerprint(provider))
+	mac.Write([]byte(encodedPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func getSessionCookieName(scope string) string {
+	hash := sha256.Sum256([]byte(scope))
+	return SESSION_COOKIE_PREFIX + hex.EncodeToString(hash[:6])
+}
+
+// Logs the visitor in to the provider's site or album for the site's
+// SessionLifetime.
+func startSession(w http.ResponseWriter, r *http.Request, provider AuthCredentialsProvider, user string) error {
+	site := getSiteForProvider(provider)
+	if site == nil {
+		return errors.New("Sessions are only available for sites and albums")
+	}
+
+	session := &Session{
+		Scope:   getSessionScope(provider),
+		User:    user,
+		Expires: time.Now().Add(site.GetSessionLifetime()).Unix(),
+	}
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+
+	// the cookie is sent for every path, as the album's photos aren't always
+	// served under the album's path. The session inside is still scoped.
+	http.SetCookie(w, &http.Cookie{
+		Name:     getSessionCookieName(session.Scope),
+		Value:    encodedPayload + "." + signSessionPayload(site, provider, encodedPayload),
+		Path:     "/",
+		Expires:  time.Unix(session.Expires, 0),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Finds a session cookie that logs the visitor in to the provider's site or
+// album, nil if there isn't one.
+func getValidSession(r *http.Request, provider AuthCredentialsProvider) *Session {
+	site := getSiteForProvider(provider)
+	if site == nil {
+		return nil
+	}
+
+	path := "/"
+	if album, ok := provider.(*Album); ok {
+		path = album.Path
+	}
+
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, SESSION_COOKIE_PREFIX) {
+			continue
+		}
+
+		parts := strings.Split(cookie.Value, ".")
+		if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signSessionPayload(site, provider, parts[0]))) {
+			continue
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			continue
+		}
+		session := &Session{}
+		if err := json.Unmarshal(payload, session); err != nil {
+			continue
+		}
+
+		if time.Now().Before(time.Unix(session.Expires, 0)) && strings.HasPrefix(path, session.Scope) {
+			return session
+		}
+	}
+	return nil
+}
+
+// Logs the visitor out of every site and album on the domain
+func endSessions(w http.ResponseWriter, r *http.Request) {
+	for _, cookie := range r.Cookies() {
+		if strings.HasPrefix(cookie.Name, SESSION_COOKIE_PREFIX) {
+			http.SetCookie(w, &http.Cookie{
+				Name:     cookie.Name,
+				Value:    "",
+				Path:     "/",
+				MaxAge:   -1,
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+}
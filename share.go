@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share links let visitors into an album behind auth without the password:
+// '<album url>?share=<token>'. Tokens are signed with the album's ShareSecret,
+// so changing the secret revokes every link handed out for the album.
+const SHARE_QUERY_PARAM = "share"
+const SHARE_COOKIE_PREFIX = "50mm_share_"
+const MIN_SHARE_SECRET_LENGTH = 16
+const DEFAULT_SHARE_DURATION = 7 * 24 * time.Hour
+
+// How many times each token with a use limit has been redeemed. This only
+// lives in memory, restarting the server resets the counts.
+var shareTokenUses = make(map[string]int)
+var shareTokenUsesMutex sync.Mutex
+
+type ShareToken struct {
+	Path    string `json:"p"`           // the album, and its child albums
+	Expires int64  `json:"e"`           // unix time
+	MaxUses int    `json:"u,omitempty"` // 0 for no limit
+	Nonce   string `json:"n"`           // so every token is different
+
+	signature string
+}
+
+func (t *ShareToken) GetExpiry() time.Time {
+	return time.Unix(t.Expires, 0)
+}
+
+func (t *ShareToken) IsExpired() bool {
+	return !time.Now().Before(t.GetExpiry())
+}
+
+// Whether the token lets visitors into the album at path
+func (t *ShareToken) Covers(path string) bool {
+	return strings.HasPrefix(path, t.Path)
+}
+
+// Creates a share token for the album that is valid for duration, and can be
+// redeemed maxUses times if that's more than 0.
+func (a *Album) NewShareToken(duration time.Duration, maxUses int) (string, error) {
+	if a.ShareSecret == "" {
+		return "", errors.New("Album has no ShareSecret")
+	}
+	if duration <= 0 {
+		return "", errors.New("Share tokens need to expire")
+	}
+	if maxUses < 0 {
+		return "", errors.New("The number of uses can't be negative")
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(&ShareToken{
+		Path:    a.Path,
+		Expires: time.Now().Add(duration).Unix(),
+		MaxUses: maxUses,
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	return encodedPayload + "." + a.signSharePayload(encodedPayload), nil
+}
+
+func (a *Album) GetShareUrl(token string) string {
+	return a.GetCanonicalUrl().String() + "?" + SHARE_QUERY_PARAM + "=" + token
+}
+
+func (a *Album) signSharePayload(encodedPayload string) string {
+	mac := hmac.New(sha256.New, []byte(a.ShareSecret))
+	mac.Write([]byte(encodedPayload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the token's signature, expiry and that it covers the album. The use
+// count isn't checked here, see redeemShareToken.
+func (a *Album) ParseShareToken(token string) (*ShareToken, error) {
+	if a.ShareSecret == "" {
+		return nil, errors.New("Album has no ShareSecret")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed share token")
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(a.signSharePayload(parts[0]))) {
+		return nil, errors.New("Invalid share token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	shareToken := &ShareToken{signature: parts[1]}
+	if err := json.Unmarshal(payload, shareToken); err != nil {
+		return nil, err
+	}
+
+	if shareToken.IsExpired() {
+		return nil, errors.New("Share token has expired")
+	}
+	if !shareToken.Covers(a.Path) {
+		return nil, errors.New("Share token is for another album")
+	}
+	return shareToken, nil
+}
+
+// Counts a use of the token, false if it has none left
+func redeemShareToken(shareToken *ShareToken) bool {
+	if shareToken.MaxUses == 0 {
+		return true
+	}
+
+	shareTokenUsesMutex.Lock()
+	defer shareTokenUsesMutex.Unlock()
+
+	if shareTokenUses[shareToken.signature] >= shareToken.MaxUses {
+		return false
+	}
+	shareTokenUses[shareToken.signature]++
+	return true
+}
+
+// One cookie per shared album, so links to different albums don't replace
+// each other.
+func getShareCookieName(shareToken *ShareToken) string {
+	hash := sha256.Sum256([]byte(shareToken.Path))
+	return SHARE_COOKIE_PREFIX + hex.EncodeToString(hash[:6])
+}
+
+// Lets the visitor in if they followed a share link for the album, or did so
+// earlier. Following the link uses up one of the token's uses and swaps it
+// for a cookie, so the photos, pages and downloads of the album, which don't
+// carry the token, work for as long as the token is valid.
+func (a *Album) HasValidShare(w http.ResponseWriter, r *http.Request) bool {
+	if a.ShareSecret == "" {
+		return false
+	}
+
+	for _, cookie := range r.Cookies() {
+		if strings.HasPrefix(cookie.Name, SHARE_COOKIE_PREFIX) {
+			if _, err := a.ParseShareToken(cookie.Value); err == nil {
+				return true
+			}
+		}
+	}
+
+	token := r.URL.Query().Get(SHARE_QUERY_PARAM)
+	if token == "" {
+		return false
+	}
+	shareToken, err := a.ParseShareToken(token)
+	if err != nil || !redeemShareToken(shareToken) {
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     getShareCookieName(shareToken),
+		Value:    token,
+		Path:     "/", // photos are served from outside the album's path too
+		Expires:  shareToken.GetExpiry(),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return true
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TEST_SHARE_SECRET = "a share secret of some length"
+
+// Albums at /a/, /ab/ and /trips/ behind a password, all with the same
+// ShareSecret so only the token's path keeps them apart.
+func loadTestShareSite(t *testing.T) *Site {
+	albums := ""
+	for _, path := range []string{"/a/", "/ab/", "/trips/"} {
+		albums += "[" + path + "]\nPath = " + path + "\nBucketPrefix = " + strings.Trim(path, "/") + "/\n" +
+			"InIndex = 0\nAuthUser = alice\nAuthPass = secret\nShareSecret = " + TEST_SHARE_SECRET + "\n"
+	}
+	return loadTestSite(t, albums)
+}
+
+func getTestShareAlbum(t *testing.T, site *Site, path string) *Album {
+	t.Helper()
+	album, err := site.GetAlbumForPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return album
+}
+
+func newTestShareToken(t *testing.T, album *Album, maxUses int) string {
+	t.Helper()
+	token, err := album.NewShareToken(time.Hour, maxUses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Visits the album with the token in the URL, and returns whether the visitor
+// was let in and the cookie they got for it.
+func followShareLink(album *Album, token string) (bool, *http.Cookie) {
+	r := httptest.NewRequest(http.MethodGet, album.Path+"?"+SHARE_QUERY_PARAM+"="+url.QueryEscape(token), nil)
+	w := httptest.NewRecorder()
+	ok := album.HasValidShare(w, r)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		return ok, nil
+	}
+	return ok, cookies[0]
+}
+
+// Visits a page of the album with just the cookie, like photos and downloads do
+func visitWithShareCookie(album *Album, cookie *http.Cookie) bool {
+	r := httptest.NewRequest(http.MethodGet, album.Path, nil)
+	r.AddCookie(cookie)
+	return album.HasValidShare(httptest.NewRecorder(), r)
+}
+
+func TestShareLink(t *testing.T) {
+	site := loadTestShareSite(t)
+	album := getTestShareAlbum(t, site, "/trips/")
+	token := newTestShareToken(t, album, 0)
+
+	r := httptest.NewRequest(http.MethodGet, "/trips/", nil)
+	w := httptest.NewRecorder()
+	if checkAndRequireAuth(w, r, album) || w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the album to require the password, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/trips/?"+SHARE_QUERY_PARAM+"="+token, nil)
+	w = httptest.NewRecorder()
+	if !checkAndRequireAuth(w, r, album) {
+		t.Fatal("Expected the share link to let the visitor in")
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !strings.HasPrefix(cookies[0].Name, SHARE_COOKIE_PREFIX) || !cookies[0].HttpOnly {
+		t.Fatalf("Expected a share cookie, got %v", cookies)
+	}
+	if !visitWithShareCookie(album, cookies[0]) {
+		t.Error("Expected the share cookie to let the visitor in")
+	}
+}
+
+func TestShareTamperedToken(t *testing.T) {
+	site := loadTestShareSite(t)
+	album := getTestShareAlbum(t, site, "/trips/")
+	other := getTestShareAlbum(t, site, "/a/")
+	token := newTestShareToken(t, album, 0)
+	parts := strings.Split(token, ".")
+
+	// the payload of a token for another album, with this token's signature
+	otherParts := strings.Split(newTestShareToken(t, other, 0), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(otherParts[0])
+	payload = []byte(strings.Replace(string(payload), `"/a/"`, `"/trips/"`, 1))
+
+	tests := map[string]string{
+		"changed signature":          parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte("not the signature")),
+		"changed payload":            base64.RawURLEncoding.EncodeToString(payload) + "." + otherParts[1],
+		"signature of another token": parts[0] + "." + otherParts[1],
+		"without signature":          parts[0],
+		"signed with another secret": parts[0] + "." + (&Album{ShareSecret: "another share secret"}).signSharePayload(parts[0]),
+	}
+
+	for name, tampered := range tests {
+		if _, err := album.ParseShareToken(tampered); err == nil {
+			t.Errorf("Expected a token with a %s to be rejected", name)
+		}
+		if ok, cookie := followShareLink(album, tampered); ok || cookie != nil {
+			t.Errorf("Expected a token with a %s not to let the visitor in", name)
+		}
+	}
+}
+
+func TestShareExpiredToken(t *testing.T) {
+	site := loadTestShareSite(t)
+	album := getTestShareAlbum(t, site, "/trips/")
+
+	payload, err := json.Marshal(&ShareToken{Path: album.Path, Expires: time.Now().Add(-time.Minute).Unix(), Nonce: "expired"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	token := encodedPayload + "." + album.signSharePayload(encodedPayload)
+
+	if _, err := album.ParseShareToken(token); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the expired token to be rejected, got %v", err)
+	}
+	if ok, _ := followShareLink(album, token); ok {
+		t.Error("Expected the expired link not to let the visitor in")
+	}
+	cookie := &http.Cookie{Name: getShareCookieName(&ShareToken{Path: album.Path}), Value: token}
+	if visitWithShareCookie(album, cookie) {
+		t.Error("Expected the expired cookie not to let the visitor in")
+	}
+}
+
+func TestShareTokenAlbums(t *testing.T) {
+	site := loadTestShareSite(t)
+	a := getTestShareAlbum(t, site, "/a/")
+	ab := getTestShareAlbum(t, site, "/ab/")
+	trips := getTestShareAlbum(t, site, "/trips/")
+	child := trips.newSubAlbum("trips/2019/")
+	if child.Path != "/trips/2019/" {
+		t.Fatalf("Unexpected child album path %s", child.Path)
+	}
+
+	tests := []struct {
+		sharedAlbum  *Album
+		visitedAlbum *Album
+		allowed      bool
+	}{
+		{a, a, true},
+		{a, ab, false}, // an album whose path starts like the shared one
+		{ab, a, false},
+		{trips, child, true},  // child albums are shared with their parent
+		{child, trips, false}, // but not the other way around
+		{child, child, true},
+	}
+
+	for _, test := range tests {
+		token := newTestShareToken(t, test.sharedAlbum, 0)
+		ok, cookie := followShareLink(test.visitedAlbum, token)
+		if ok != test.allowed {
+			t.Errorf("Expected a link for %s to let visitors into %s: %v, got %v",
+				test.sharedAlbum.Path, test.visitedAlbum.Path, test.allowed, ok)
+		}
+
+		// a cookie for the shared album, as if the link was followed there
+		_, cookie = followShareLink(test.sharedAlbum, token)
+		if cookie == nil {
+			t.Fatalf("Expected a cookie for %s", test.sharedAlbum.Path)
+		}
+		if visitWithShareCookie(test.visitedAlbum, cookie) != test.allowed {
+			t.Errorf("Expected a cookie for %s to let visitors into %s: %v",
+				test.sharedAlbum.Path, test.visitedAlbum.Path, test.allowed)
+		}
+	}
+}
+
+func TestShareMaxUses(t *testing.T) {
+	site := loadTestShareSite(t)
+	album := getTestShareAlbum(t, site, "/trips/")
+	token := newTestShareToken(t, album, 2)
+
+	ok, firstCookie := followShareLink(album, token)
+	if !ok || firstCookie == nil {
+		t.Fatal("Expected the first use to let the visitor in")
+	}
+	if ok, _ := followShareLink(album, token); !ok {
+		t.Fatal("Expected the second use to let the visitor in")
+	}
+	if ok, cookie := followShareLink(album, token); ok || cookie != nil {
+		t.Error("Expected the link to stop working after 2 uses")
+	}
+
+	// visitors who already followed the link keep browsing the album
+	for i := 0; i < 3; i++ {
+		if !visitWithShareCookie(album, firstCookie) {
+			t.Fatal("Expected the cookie of an earlier use to keep working")
+		}
+	}
+
+	// each token has its own count
+	if ok, _ := followShareLink(album, newTestShareToken(t, album, 1)); !ok {
+		t.Error("Expected a new token to have its own uses")
+	}
+}
+
+func TestShareSecretRotation(t *testing.T) {
+	site := loadTestShareSite(t)
+	album := getTestShareAlbum(t, site, "/trips/")
+	token := newTestShareToken(t, album, 0)
+
+	_, cookie := followShareLink(album, token)
+	if cookie == nil {
+		t.Fatal("Expected a share cookie")
+	}
+
+	album.ShareSecret = "a brand new share secret"
+	if ok, _ := followShareLink(album, token); ok {
+		t.Error("Expected changing the ShareSecret to revoke the link")
+	}
+	if visitWithShareCookie(album, cookie) {
+		t.Error("Expected changing the ShareSecret to revoke the cookie")
+	}
+
+	album.ShareSecret = ""
+	if ok, _ := followShareLink(album, newTestShareToken(t, getTestShareAlbum(t, site, "/a/"), 0)); ok {
+		t.Error("Expected an album without a ShareSecret not to accept share links")
+	}
+}
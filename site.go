@@ -4,25 +4,50 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"io/ioutil"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/go-ini/ini"
 )
 
+var DEFAULT_SRCSET_WIDTHS = []int{400, 800, 1200, 1600, 2000}
+
 type Site struct {
 	Domain          string
 	CanonicalSecure bool
 
-	AuthUser string
-	AuthPass string
+	AuthUser      string
+	AuthPass      string // plaintext, or a bcrypt or argon2 hash, see auth.go
+	AuthUsersFile string // htpasswd style file of users who can see the site
+	authUsers     map[string]string
+	AuthMode      string // see session.go
+
+	// for AuthMode = form and oidc, see session.go
+	SessionSecret   string
+	SessionLifetime time.Duration
+
+	// for AuthMode = oidc, albums can override them, see oidc.go
+	OidcIssuer         string
+	OidcClientId       string
+	OidcClientSecret   string
+	OidcAllowedEmails  []string `delim:","`
+	OidcAllowedDomains []string `delim:","`
+
+	// let in ID tokens without an email_verified claim, for providers that
+	// don't send one, see oidc.go
+	OidcTrustUnverifiedEmail bool
+
+	Storage     string // "s3" (default) or "filesystem"
+	StorageRoot string // directory photos are read from for filesystem storage
 
 	S3Host       string
 	S3ForcePathStyle  bool
@@ -34,6 +59,10 @@ type Site struct {
 	ResizingServiceSecret string
 	ImageProxy            string
 	BaseUrl               string
+	ImageCacheDir         string   // where the builtin resizing service caches images
+	ImageCacheSize        int64    // in MB
+	SrcSetWidths          []int    `delim:","` // widths offered to browsers in srcset attributes
+	OutputFormats         []string `delim:","` // formats offered to browsers in picture tags, best first
 
 	AWS_SECRET_KEY_ID                  string          `ini:"AWSKeyId"`
 	AWS_SECRET_KEY                     string          `ini:"AWSKey"`
@@ -46,9 +75,35 @@ type Site struct {
 	MetaTitle string
 
 	HasAlbumIndex bool
-	Albums        []*Album
+	Albums        []*Album // albums configured in the INI file
+
+	ShowExif bool // camera details on photo pages, see exif.go
+
+	// keep search engines out, see sitemap.go
+	NoIndex        bool
+	RobotsDisallow []string `delim:","`
+
+	// discover albums from the folders under AutoAlbumsPrefix, see autoalbums.go
+	AutoAlbums       bool
+	AutoAlbumsPrefix string
 
-	awsSession *session.Session
+	MaxAlbumKeys int // upper bound on the number of objects listed per album
+
+	// How long album keys and ordering files are cached for, albums can
+	// override these. NegativeCacheTTL applies to missing/broken ordering files.
+	KeyCacheTTL      time.Duration
+	OrderingCacheTTL time.Duration
+	NegativeCacheTTL time.Duration
+
+	EventTopicArn     string // SNS topic bucket events are accepted from
+	EventWebhookToken string // token MinIO webhook targets must send
+
+	storage    Storage
+	imageCache *ImageCache
+
+	AutoAlbumCache        atomic.Value // []*Album
+	LastAutoAlbumsUpdate  atomic.Value // time.Time, read without the mutex by GetAutoAlbums
+	AutoAlbumsUpdateMutex sync.Mutex
 }
 
 func GetPrivateKeyFromFile(path string) (*rsa.PrivateKey, error) {
@@ -95,6 +150,12 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		return nil, err
 	}
 
+	if s.AuthUsersFile != "" {
+		if s.authUsers, err = LoadAuthUsersFile(s.AuthUsersFile); err != nil {
+			return nil, err
+		}
+	}
+
 	if s.BucketRegion == "" && s.BucketName == "" {
 		s.BucketRegion = defaultSection.Key("Region").String()
 		s.BucketName = defaultSection.Key("Bucket").String()
@@ -112,7 +173,7 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		}
 	}
 
-	if len(s.Albums) == 0 { // Check if the config is old style and create default album
+	if len(s.Albums) == 0 && !s.AutoAlbums { // Check if the config is old style and create default album
 		if album, err := NewAlbum(s, "/", defaultSection.Key("Prefix").String(),
 			defaultSection.Key("AuthUser").String(), defaultSection.Key("AuthPass").String(),
 			defaultSection.Key("MetaTitle").String(), defaultSection.Key("AlbumTitle").String()); err != nil {
@@ -126,25 +187,14 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		return nil, err
 	}
 
-	sess_config := &aws.Config{
-		Region:      aws.String(s.BucketRegion),
-		Credentials: credentials.NewStaticCredentials(s.AWS_SECRET_KEY_ID, s.AWS_SECRET_KEY, ""),
-	}
-	if s.S3Host != "" {
-		sess_config.Endpoint = aws.String(s.S3Host)
-	}
-	if s.S3ForcePathStyle {
-		sess_config.S3ForcePathStyle = aws.Bool(true)
-	}
-
-	if sess, err := session.NewSession(sess_config); err != nil {
-		return nil, err
+	if s.Storage == "filesystem" {
+		s.storage = NewFilesystemStorage(s)
 	} else {
-		s.awsSession = sess
-	}
-
-	if err != nil {
-		return nil, err
+		if s3Storage, err := NewS3Storage(s); err != nil {
+			return nil, err
+		} else {
+			s.storage = s3Storage
+		}
 	}
 
 	if s.UseImgix {
@@ -156,6 +206,18 @@ func LoadSiteFromFile(path string) (*Site, error) {
 		s.ResizingService = "imgix"
 	}
 
+	if s.ResizingService == "builtin" {
+		if s.ImageCacheDir == "" {
+			s.ImageCacheDir = filepath.Join(os.TempDir(), "fiftymm-images", s.Domain)
+		}
+		if s.ImageCacheSize == 0 {
+			s.ImageCacheSize = DEFAULT_IMAGE_CACHE_SIZE_MB
+		}
+		if s.imageCache, err = GetImageCache(s.ImageCacheDir, s.ImageCacheSize*1024*1024); err != nil {
+			return nil, err
+		}
+	}
+
 	// set up private key for thumbor+cloudfront, missing paths, etc
 	// are brought to our attention during validation
 	if s.ResizingService == "thumbor+cloudfront" {
@@ -170,14 +232,82 @@ func LoadSiteFromFile(path string) (*Site, error) {
 }
 
 func (s *Site) IsValid() error {
-	if s.Domain == "" || s.BucketRegion == "" || s.BucketName == "" || s.AWS_SECRET_KEY_ID == "" || s.AWS_SECRET_KEY == "" {
-		return errors.New("Domain, BucketRegion, BucketName, AWSKeyId, and AWSKey are required parameters that must have valid values")
+	if s.Domain == "" {
+		return errors.New("Domain is a required parameter that must have a valid value")
+	}
+
+	switch s.Storage {
+	case "", "s3":
+		if s.BucketRegion == "" || s.BucketName == "" || s.AWS_SECRET_KEY_ID == "" || s.AWS_SECRET_KEY == "" {
+			return errors.New("BucketRegion, BucketName, AWSKeyId, and AWSKey are required parameters for S3 storage that must have valid values")
+		}
+	case "filesystem":
+		if s.StorageRoot == "" {
+			return errors.New("Filesystem storage requires the path to the photos directory (config StorageRoot)")
+		}
+		if info, err := os.Stat(s.StorageRoot); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("StorageRoot '%s' is not a directory", s.StorageRoot)
+		}
+	default:
+		return fmt.Errorf("Unrecognized storage '%s', valid options are s3, filesystem", s.Storage)
 	}
 
-	if len(s.Albums) == 0 {
+	if err := ValidatePasswordHash(s.AuthPass); err != nil {
+		return fmt.Errorf("AuthPass can't be used. Error: %s", err.Error())
+	}
+
+	if len(s.Albums) == 0 && !s.AutoAlbums {
 		return errors.New("Can't have a site with 0 albums")
 	}
 
+	if s.AutoAlbumsPrefix != "" && !s.AutoAlbums {
+		return errors.New("AutoAlbumsPrefix requires AutoAlbums to be turned on")
+	}
+
+	if s.HasS3Events() && s.Storage == "filesystem" {
+		return errors.New("EventTopicArn and EventWebhookToken can only be used with S3 storage")
+	}
+
+	if s.MaxAlbumKeys < 0 {
+		return errors.New("MaxAlbumKeys can't be negative")
+	}
+
+	for _, w := range s.SrcSetWidths {
+		if w <= 0 {
+			return errors.New("SrcSetWidths must be a comma separated list of positive widths")
+		}
+	}
+
+	for _, f := range s.OutputFormats {
+		if _, ok := OUTPUT_FORMAT_MIME_TYPES[normalizeOutputFormat(f)]; !ok {
+			return fmt.Errorf("Unknown output format '%s', must be one of avif, webp, jpeg, png", f)
+		}
+	}
+
+	if s.KeyCacheTTL < 0 || s.OrderingCacheTTL < 0 || s.NegativeCacheTTL < 0 {
+		return errors.New("KeyCacheTTL, OrderingCacheTTL and NegativeCacheTTL can't be negative")
+	}
+
+	if s.AuthMode != "" && !IsValidAuthMode(s.AuthMode) {
+		return fmt.Errorf("Unknown AuthMode '%s', valid options are basic, form and oidc", s.AuthMode)
+	}
+
+	if s.AuthMode == AUTH_MODE_OIDC {
+		if err := s.GetOidcConfig().IsValid(); err != nil {
+			return err
+		}
+	}
+
+	if s.SessionSecret != "" && len(s.SessionSecret) < MIN_SESSION_SECRET_LENGTH {
+		return fmt.Errorf("SessionSecret needs to be at least %d characters long", MIN_SESSION_SECRET_LENGTH)
+	}
+
+	if s.SessionLifetime < 0 {
+		return errors.New("SessionLifetime can't be negative")
+	}
+
 	if s.HasAlbumIndex {
 		for _, a := range s.Albums {
 			if a.Path == "/" {
@@ -216,16 +346,23 @@ func (s *Site) IsValid() error {
 		if s.ImageProxy == "" {
 			return errors.New("ImageProxy requires proxy's URL")
 		}
+	case "builtin":
+		if s.ResizingServiceSecret == "" {
+			return errors.New("builtin resizing service requires a secret for URL signing (config ResizingServiceSecret)")
+		}
+		if s.ImageCacheSize < 0 {
+			return errors.New("ImageCacheSize can't be negative")
+		}
 	default:
 		return fmt.Errorf("Unrecognized/Unimplemented resizing service '%s',"+
-			" valid options are imgix, thumbor, thumbor+cloudfront", s.ResizingService)
+			" valid options are imgix, thumbor, thumbor+cloudfront, imageproxy, builtin", s.ResizingService)
 	}
 
 	return nil
 }
 
 func (s *Site) HasAuth() bool {
-	return s.AuthUser != "" && s.AuthPass != ""
+	return (s.AuthUser != "" && s.AuthPass != "") || len(s.authUsers) > 0 || s.AuthMode == AUTH_MODE_OIDC
 }
 
 func (s *Site) GetAuthUser() string {
@@ -236,6 +373,17 @@ func (s *Site) GetAuthPass() string {
 	return s.AuthPass
 }
 
+func (s *Site) GetAuthUsers() map[string]string {
+	return s.authUsers
+}
+
+func (s *Site) GetAuthMode() string {
+	if s.AuthMode != "" {
+		return s.AuthMode
+	}
+	return AUTH_MODE_BASIC
+}
+
 func (s *Site) GetCanonicalUrl() *url.URL {
 	proto, domain := "http", s.Domain
 	if s.CanonicalSecure {
@@ -251,8 +399,8 @@ func (s *Site) GetCanonicalUrl() *url.URL {
 func (s *Site) GetAlbumsForIndex() []*Album {
 	indexAlbums := make([]*Album, 0)
 
-	for _, a := range s.Albums {
-		if a.InIndex {
+	for _, a := range s.GetAllAlbums() {
+		if a.IsInIndex() {
 			indexAlbums = append(indexAlbums, a)
 		}
 	}
@@ -260,23 +408,73 @@ func (s *Site) GetAlbumsForIndex() []*Album {
 	return indexAlbums
 }
 
-func (s *Site) GetS3Service() (*s3.S3, error) {
-	return s3.New(s.awsSession), nil
+func (s *Site) GetMaxAlbumKeys() int {
+	if s.MaxAlbumKeys > 0 {
+		return s.MaxAlbumKeys
+	}
+	return DEFAULT_MAX_ALBUM_KEYS
+}
+
+func (s *Site) GetSrcSetWidths() []int {
+	if len(s.SrcSetWidths) > 0 {
+		return s.SrcSetWidths
+	}
+	return DEFAULT_SRCSET_WIDTHS
+}
+
+func normalizeOutputFormat(format string) OutputFormat {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return OutputFormat(format)
+}
+
+func (s *Site) GetOutputFormats() []OutputFormat {
+	formats := make([]OutputFormat, 0, len(s.OutputFormats))
+	for _, f := range s.OutputFormats {
+		formats = append(formats, normalizeOutputFormat(f))
+	}
+	return formats
+}
+
+func (s *Site) GetKeyCacheTTL() time.Duration {
+	if s.KeyCacheTTL > 0 {
+		return s.KeyCacheTTL
+	}
+	return CACHE_INTERVAL
+}
+
+func (s *Site) GetOrderingCacheTTL() time.Duration {
+	if s.OrderingCacheTTL > 0 {
+		return s.OrderingCacheTTL
+	}
+	return CACHE_INTERVAL
+}
+
+func (s *Site) GetNegativeCacheTTL() time.Duration {
+	if s.NegativeCacheTTL > 0 {
+		return s.NegativeCacheTTL
+	}
+	return CACHE_INTERVAL
+}
+
+func (s *Site) GetStorage() Storage {
+	return s.storage
 }
 
 func (s *Site) GetPhotoForKey(key string) Renderable {
 	if s.ResizingService == "" {
-		return s.GetS3Photo(key)
+		return s.GetStoragePhoto(key)
 	} else {
 		return s.GetScaledPhoto(key)
 	}
 }
 
-func (s *Site) GetS3Photo(key string) *S3Photo {
-	return &S3Photo{
+func (s *Site) GetStoragePhoto(key string) *StoragePhoto {
+	return &StoragePhoto{
 		key,
-		s.BucketName,
-		s.awsSession,
+		s.storage,
 	}
 }
 
@@ -309,10 +507,18 @@ func (s *Site) GetScaledPhoto(key string) Renderable {
 				AWSCloudfrontKeyPairId:  s.AWS_CLOUDFRONT_PRIVATE_KEY_PAIR_ID,
 				AWSCloudfrontPrivateKey: s.CloudfrontPrivateKey,
 			}
+		} else if s.ResizingService == "builtin" {
+			return &BuiltinRescaledPhoto{
+				RescaledPhoto: &RescaledPhoto{
+					key,
+					s.GetCanonicalUrl(),
+				},
+				Secret: s.ResizingServiceSecret,
+			}
 		} else if s.ResizingService == "imageproxy" {
 			return &ImageProxy{
-				S3Photo:    s.GetS3Photo(key),
-				ImageProxy: s.ImageProxy,
+				StoragePhoto: s.GetStoragePhoto(key),
+				ImageProxy:   s.ImageProxy,
 			}
 		} else {
 			// it should never come to this due to configuration validation,
@@ -322,15 +528,82 @@ func (s *Site) GetScaledPhoto(key string) Renderable {
 	}
 }
 
+// true if both sites read their photos from the same place
+func (s *Site) HasSameStorageAs(other *Site) bool {
+	return s.Storage == other.Storage &&
+		s.StorageRoot == other.StorageRoot &&
+		s.S3Host == other.S3Host &&
+		s.BucketRegion == other.BucketRegion &&
+		s.BucketName == other.BucketName
+}
+
+// Used when reloading configs, albums that still read the same photos as an
+// album in the old site take over its caches.
+func (s *Site) InheritCachesFrom(old *Site) {
+	if !s.HasSameStorageAs(old) {
+		return
+	}
+
+	for _, album := range s.Albums {
+		if oldAlbum, err := old.GetAlbumForPath(album.Path); err == nil && oldAlbum.BucketPrefix == album.BucketPrefix {
+			album.InheritCachesFrom(oldAlbum)
+		}
+	}
+
+	if s.AutoAlbums && old.AutoAlbums && s.AutoAlbumsPrefix == old.AutoAlbumsPrefix {
+		s.inheritAutoAlbumsFrom(old)
+	}
+}
+
 func (s *Site) GetAlbumForPath(path string) (*Album, error) {
 	if path[len(path)-1] != '/' {
 		path = path + "/"
 	}
-	for _, album := range s.Albums {
+	albums := s.GetAllAlbums()
+	for _, album := range albums {
 		if album.Path == path {
 			return album, nil
 		}
 	}
+	for _, album := range albums {
+		if subAlbum := album.GetSubAlbumForPath(path); subAlbum != nil {
+			return subAlbum, nil
+		}
+	}
 
 	return nil, fmt.Errorf("Could not find album in site %s for path '%s'", s.Domain, path)
 }
+
+// Finds the album a storage key belongs to, i.e: the album whose BucketPrefix
+// is the folder holding the key.
+func (s *Site) GetAlbumForKey(key string) (*Album, error) {
+	if album, exact := s.GetNearestAlbumForKey(key); album != nil && exact {
+		return album, nil
+	}
+
+	return nil, fmt.Errorf("Could not find album in site %s for key '%s'", s.Domain, key)
+}
+
+// Like GetAlbumForKey, but if the key is in a folder we don't have a sub album
+// for yet, returns the album that folder will become a child of, and false.
+func (s *Site) GetNearestAlbumForKey(key string) (*Album, bool) {
+	prefix := key[:strings.LastIndex(key, "/")+1]
+	albums := s.GetAllAlbums()
+	for _, album := range albums {
+		if album.BucketPrefix == prefix {
+			return album, true
+		}
+	}
+
+	var nearest *Album
+	for _, album := range albums {
+		if album.SubAlbums && strings.HasPrefix(prefix, album.BucketPrefix) {
+			if found, exact := album.GetNearestAlbumForPrefix(prefix); exact {
+				return found, true
+			} else if nearest == nil || len(found.BucketPrefix) > len(nearest.BucketPrefix) {
+				nearest = found
+			}
+		}
+	}
+	return nearest, false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const SITEMAP_ROUTE = "/sitemap.xml"
+const ROBOTS_ROUTE = "/robots.txt"
+
+const SITEMAP_DATE_FORMAT = "2006-01-02"
+
+type SitemapUrlSet struct {
+	XMLName xml.Name      `xml:"urlset"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	ImageNs string        `xml:"xmlns:image,attr"`
+	Urls    []*SitemapUrl `xml:"url"`
+}
+
+type SitemapUrl struct {
+	Loc     string          `xml:"loc"`
+	LastMod string          `xml:"lastmod,omitempty"`
+	Images  []*SitemapImage `xml:"image:image"`
+}
+
+type SitemapImage struct {
+	Loc string `xml:"image:loc"`
+}
+
+// The albums search engines may crawl: albums without auth that are shown in
+// the index, along with their sub albums. Sites without an index serve an
+// album at '/' as their home page, which is listed whether or not it's in the
+// index. Albums kept out of the index are unlisted, so they're left out.
+func (s *Site) GetPublicAlbums() []*Album {
+	var albums []*Album
+	var addAlbum func(album *Album)
+	addAlbum = func(album *Album) {
+		if album.HasAuth() {
+			return
+		}
+		albums = append(albums, album)
+		for _, subAlbum := range album.GetSubAlbums() {
+			addAlbum(subAlbum)
+		}
+	}
+
+	for _, album := range s.GetAllAlbums() {
+		if album.IsInIndex() || (!s.HasAlbumIndex && album.Path == "/") {
+			addAlbum(album)
+		}
+	}
+	return albums
+}
+
+// Lists the index, the public albums and all their photo pages, with the
+// photos themselves as image extensions.
+func handleSitemap(site *Site, w http.ResponseWriter, r *http.Request) {
+	if site.NoIndex || site.HasAuth() {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+		return
+	}
+
+	urlSet := &SitemapUrlSet{
+		Xmlns:   "http://www.sitemaps.org/schemas/sitemap/0.9",
+		ImageNs: "http://www.google.com/schemas/sitemap-image/1.1",
+	}
+	if site.HasAlbumIndex {
+		indexUrl := site.GetCanonicalUrl()
+		indexUrl.Path = "/"
+		urlSet.Urls = append(urlSet.Urls, &SitemapUrl{Loc: indexUrl.String()})
+	}
+
+	widths := site.GetSrcSetWidths()
+	largestWidth := widths[len(widths)-1]
+	for _, album := range site.GetPublicAlbums() {
+		albumOrdering, err := album.GetOrderedPhotos()
+		if err != nil {
+			continue
+		}
+
+		albumUrl := album.GetCanonicalUrl().String()
+		sitemapUrl := &SitemapUrl{Loc: albumUrl}
+		if lastModified := album.GetLastModified(); !lastModified.IsZero() {
+			sitemapUrl.LastMod = lastModified.Format(SITEMAP_DATE_FORMAT)
+		}
+		urlSet.Urls = append(urlSet.Urls, sitemapUrl)
+
+		for _, photo := range albumOrdering.Ordering {
+			photoUrl := &SitemapUrl{Loc: albumUrl + photo.Slug()}
+			if imageUrl := photo.GetPhotoForWidth(largestWidth); imageUrl != "" {
+				photoUrl.Images = []*SitemapImage{{imageUrl}}
+			}
+			urlSet.Urls = append(urlSet.Urls, photoUrl)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(urlSet); err != nil {
+		log.Printf("Unable to write sitemap for site %s. Error: %s\n", site.Domain, err.Error())
+	}
+}
+
+// Keeps crawlers out of albums behind auth, the paths in RobotsDisallow and,
+// for NoIndex sites, everything.
+func handleRobotsTxt(site *Site, w http.ResponseWriter, r *http.Request) {
+	var robots strings.Builder
+	robots.WriteString("User-agent: *\n")
+
+	if site.NoIndex || site.HasAuth() {
+		robots.WriteString("Disallow: /\n")
+	} else {
+		disallowed := make(map[string]bool)
+		for _, album := range site.GetAllAlbums() {
+			if album.HasAuth() && !disallowed[album.Path] {
+				disallowed[album.Path] = true
+				fmt.Fprintf(&robots, "Disallow: %s\n", album.Path)
+			}
+		}
+		for _, path := range site.RobotsDisallow {
+			if path = strings.TrimSpace(path); path != "" && !disallowed[path] {
+				disallowed[path] = true
+				fmt.Fprintf(&robots, "Disallow: %s\n", path)
+			}
+		}
+
+		if len(disallowed) == 0 {
+			// an empty Disallow allows everything
+			robots.WriteString("Disallow:\n")
+		}
+
+		sitemapUrl := site.GetCanonicalUrl()
+		sitemapUrl.Path = SITEMAP_ROUTE
+		fmt.Fprintf(&robots, "\nSitemap: %s\n", sitemapUrl.String())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(robots.String()))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const TEST_SITEMAP_ALBUMS = "[Trips]\nPath = /trips/\nBucketPrefix = trips/\n" +
+	"[Unlisted]\nPath = /unlisted/\nBucketPrefix = unlisted/\nInIndex = 0\n" +
+	"[Private]\nPath = /private/\nBucketPrefix = private/\nInIndex = 0\nAuthUser = alice\nAuthPass = secret\n"
+
+func getPublicAlbumPaths(site *Site) []string {
+	var paths []string
+	for _, album := range site.GetPublicAlbums() {
+		paths = append(paths, album.Path)
+	}
+	return paths
+}
+
+func TestPublicAlbums(t *testing.T) {
+	site := loadTestSite(t, "HasAlbumIndex = 1\n"+TEST_SITEMAP_ALBUMS)
+	if paths := strings.Join(getPublicAlbumPaths(site), " "); paths != "/trips/" {
+		t.Errorf("Expected only /trips/ to be public, got %s", paths)
+	}
+}
+
+func TestPublicAlbumsWithoutIndex(t *testing.T) {
+	// the home page of a site without an index doesn't need to be in it
+	site := loadTestSite(t, "[Home]\nPath = /\nBucketPrefix = trips/\nInIndex = 0\n"+TEST_SITEMAP_ALBUMS)
+	if paths := strings.Join(getPublicAlbumPaths(site), " "); paths != "/ /trips/" {
+		t.Errorf("Expected / and /trips/ to be public, got %s", paths)
+	}
+
+	writeTestPhoto(t, site, "trips/beach.jpg")
+	w := httptest.NewRecorder()
+	handleSitemap(site, w, httptest.NewRequest(http.MethodGet, SITEMAP_ROUTE, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a sitemap, got %d", w.Code)
+	}
+	for _, loc := range []string{"http://photos.example.com/<", "http://photos.example.com/beach.jpg<",
+		"http://photos.example.com/trips/<"} {
+		if !strings.Contains(w.Body.String(), "<loc>"+loc) {
+			t.Errorf("Expected %s in the sitemap", strings.TrimSuffix(loc, "<"))
+		}
+	}
+	if strings.Contains(w.Body.String(), "/unlisted/") || strings.Contains(w.Body.String(), "/private/") {
+		t.Errorf("Expected unlisted and private albums to be left out, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How photos that aren't pinned by an ordering file are sorted, set with the
+// album's SortBy option or 'sort' in its ordering.yaml.
+const (
+	SORT_BY_NAME          = "name" // natural filename order, the default
+	SORT_BY_NAME_DESC     = "name-desc"
+	SORT_BY_MODIFIED      = "modified" // when the photo was uploaded
+	SORT_BY_MODIFIED_DESC = "modified-desc"
+	SORT_BY_TAKEN         = "taken" // EXIF DateTimeOriginal
+	SORT_BY_TAKEN_DESC    = "taken-desc"
+)
+
+// sorting by capture time reads the EXIF data of every photo in the album the
+// first time round, with this many workers.
+const EXIF_SORT_CONCURRENCY = 8
+
+func IsValidSortBy(sortBy string) bool {
+	switch sortBy {
+	case SORT_BY_NAME, SORT_BY_NAME_DESC, SORT_BY_MODIFIED, SORT_BY_MODIFIED_DESC, SORT_BY_TAKEN, SORT_BY_TAKEN_DESC:
+		return true
+	}
+	return false
+}
+
+// The ordering file's sort takes precedence over the INI file, like album.yaml does
+func (a *Album) GetSortBy(albumOrderingConfig AlbumOrderingConfig) string {
+	if albumOrderingConfig.Sort != "" {
+		return albumOrderingConfig.Sort
+	}
+	if a.SortBy != "" {
+		return a.SortBy
+	}
+	return SORT_BY_NAME
+}
+
+// The album's photos in the order of a sort, see refreshKeyCache
+type sortedKeys struct {
+	sortBy string
+	keys   []string
+}
+
+// The keys of the photos, without the album's yaml files. Always a new slice,
+// so it can be sorted.
+func photoKeys(keys []string) []string {
+	var cleanKeys []string
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ORDERING_YAML_NAME) && !strings.HasSuffix(key, ALBUM_YAML_NAME) {
+			cleanKeys = append(cleanKeys, key)
+		}
+	}
+	return cleanKeys
+}
+
+// Sorts keys in place. Keys come natsorted from the key cache, so photos with
+// the same modification or capture time stay in filename order.
+func (a *Album) sortKeys(keys []string, sortBy string, objects map[string]*StorageObject) {
+	switch sortBy {
+	case SORT_BY_NAME_DESC:
+		for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	case SORT_BY_MODIFIED, SORT_BY_MODIFIED_DESC:
+		times := make(map[string]time.Time, len(keys))
+		for _, key := range keys {
+			if object, ok := objects[key]; ok {
+				times[key] = object.LastModified
+			}
+		}
+		sortKeysByTime(keys, times, sortBy == SORT_BY_MODIFIED_DESC)
+	case SORT_BY_TAKEN, SORT_BY_TAKEN_DESC:
+		sortKeysByTime(keys, a.getTakenTimes(keys, objects), sortBy == SORT_BY_TAKEN_DESC)
+	}
+}
+
+// Photos we don't have a time for go last, whichever the direction.
+func sortKeysByTime(keys []string, times map[string]time.Time, descending bool) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		ti, tj := times[keys[i]], times[keys[j]]
+		if ti.IsZero() || tj.IsZero() {
+			return !ti.IsZero() && tj.IsZero()
+		}
+		if descending {
+			return ti.After(tj)
+		}
+		return ti.Before(tj)
+	})
+}
+
+// Photos whose EXIF data we already have aren't read again, unless objects
+// says they've changed.
+func (a *Album) getTakenTimes(keys []string, objects map[string]*StorageObject) map[string]time.Time {
+	times := make(map[string]time.Time, len(keys))
+	var timesMutex sync.Mutex
+	var wg sync.WaitGroup
+	keysToRead := make(chan string)
+
+	for i := 0; i < EXIF_SORT_CONCURRENCY; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keysToRead {
+				var lastModified time.Time
+				if object, ok := objects[key]; ok {
+					lastModified = object.LastModified
+				}
+				if photoExif := a.getExifForObject(key, lastModified); photoExif != nil {
+					timesMutex.Lock()
+					times[key] = photoExif.Taken
+					timesMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, key := range keys {
+		keysToRead <- key
+	}
+	close(keysToRead)
+	wg.Wait()
+	return times
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"path"
+	"time"
+)
+
+var ErrObjectNotFound = errors.New("Object not found in storage")
+
+// The Content-Disposition that makes browsers save an object under its file name
+func attachmentDisposition(key string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(key)})
+}
+
+// A single object (photo, ordering file, etc) as reported by a Storage backend
+type StorageObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Storage is the interface 50mm uses to read albums, it's implemented once per
+// backend (S3, local filesystem). Keys are always '/' separated and relative to
+// the root of the bucket/directory.
+type Storage interface {
+	// ListObjects returns the objects directly under prefix (i.e: not in any
+	// sub-folders), up to maxKeys of them. The returned bool is true if
+	// there were more objects than maxKeys.
+	ListObjects(prefix string, maxKeys int) ([]*StorageObject, bool, error)
+	// ListPrefixes returns the sub-folders directly under prefix, as full
+	// prefixes ending in '/'.
+	ListPrefixes(prefix string) ([]string, error)
+	// GetObject returns the contents of the object, or ErrObjectNotFound.
+	GetObject(key string) (io.ReadCloser, error)
+	// GetObjectRange returns up to length bytes of the object, starting at
+	// offset, or ErrObjectNotFound.
+	GetObjectRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	// StatObject returns the metadata of the object, or ErrObjectNotFound.
+	StatObject(key string) (*StorageObject, error)
+	// GetObjectUrl returns a URL a browser can use to view the object.
+	GetObjectUrl(key string) (string, error)
+	// GetObjectDownloadUrl returns a short lived URL browsers save the object
+	// from, under its file name, instead of showing it.
+	GetObjectDownloadUrl(key string) (string, error)
+}
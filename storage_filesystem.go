@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// URL prefix that photos stored on the local filesystem are served under.
+const FILESYSTEM_STORAGE_ROUTE = "/_storage/"
+
+// Serves albums out of a local directory tree. Keys map to paths relative to
+// Root, so a BucketPrefix of 'baku/' reads photos from '<Root>/baku/'.
+type FilesystemStorage struct {
+	Root string
+
+	site *Site
+}
+
+func NewFilesystemStorage(s *Site) *FilesystemStorage {
+	return &FilesystemStorage{
+		Root: s.StorageRoot,
+		site: s,
+	}
+}
+
+// pathForKey maps a key to a path inside Root. Keys are cleaned as if they
+// were absolute, so '..' can never escape the root directory.
+func (st *FilesystemStorage) pathForKey(key string) string {
+	return filepath.Join(st.Root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (st *FilesystemStorage) ListObjects(prefix string, maxKeys int) ([]*StorageObject, bool, error) {
+	// prefixes are folders in our case, anything after the last '/' is a
+	// partial file name we need to match against.
+	dir, namePrefix := path.Split(prefix)
+
+	infos, err := ioutil.ReadDir(st.pathForKey(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	var objects []*StorageObject
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), namePrefix) {
+			continue
+		}
+		if len(objects) == maxKeys {
+			return objects, true, nil
+		}
+		objects = append(objects, &StorageObject{
+			Key:          dir + info.Name(),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	}
+	return objects, false, nil
+}
+
+func (st *FilesystemStorage) ListPrefixes(prefix string) ([]string, error) {
+	dir, namePrefix := path.Split(prefix)
+
+	infos, err := ioutil.ReadDir(st.pathForKey(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), namePrefix) {
+			prefixes = append(prefixes, dir+info.Name()+"/")
+		}
+	}
+	return prefixes, nil
+}
+
+func (st *FilesystemStorage) GetObject(key string) (io.ReadCloser, error) {
+	f, err := os.Open(st.pathForKey(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// a file that can only be read up to the end of the requested range
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+func (st *FilesystemStorage) GetObjectRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(st.pathForKey(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &limitedFile{io.LimitReader(f, length), f}, nil
+}
+
+func (st *FilesystemStorage) StatObject(key string) (*StorageObject, error) {
+	info, err := os.Stat(st.pathForKey(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, ErrObjectNotFound
+	}
+	return &StorageObject{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+// Photos are served by 50mm itself (see handleStorageObject). We return an
+// absolute URL so that resizing services like imageproxy can fetch it too.
+func (st *FilesystemStorage) GetObjectUrl(key string) (string, error) {
+	u := st.site.GetCanonicalUrl()
+	u.Path = FILESYSTEM_STORAGE_ROUTE + strings.TrimLeft(key, "/")
+	return u.String(), nil
+}
+
+// the same URL, handleStorageObject sends it as an attachment
+func (st *FilesystemStorage) GetObjectDownloadUrl(key string) (string, error) {
+	u := st.site.GetCanonicalUrl()
+	u.Path = FILESYSTEM_STORAGE_ROUTE + strings.TrimLeft(key, "/")
+	u.RawQuery = "download=1"
+	return u.String(), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const S3_PRESIGN_DURATION = 24 * time.Hour
+const S3_DOWNLOAD_PRESIGN_DURATION = 5 * time.Minute
+
+type S3Storage struct {
+	BucketName string
+
+	awsSession *session.Session
+}
+
+func NewS3Storage(s *Site) (*S3Storage, error) {
+	sess_config := &aws.Config{
+		Region:      aws.String(s.BucketRegion),
+		Credentials: credentials.NewStaticCredentials(s.AWS_SECRET_KEY_ID, s.AWS_SECRET_KEY, ""),
+	}
+	if s.S3Host != "" {
+		sess_config.Endpoint = aws.String(s.S3Host)
+	}
+	if s.S3ForcePathStyle {
+		sess_config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess, err := session.NewSession(sess_config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{
+		BucketName: s.BucketName,
+		awsSession: sess,
+	}, nil
+}
+
+func (st *S3Storage) GetS3Service() *s3.S3 {
+	return s3.New(st.awsSession)
+}
+
+// S3 returns at most 1000 keys per request, so we keep following
+// continuation tokens until the listing is done or we hit maxKeys.
+func (st *S3Storage) ListObjects(prefix string, maxKeys int) ([]*StorageObject, bool, error) {
+	var objects []*StorageObject
+	truncated := false
+
+	err := st.GetS3Service().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(st.BucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if len(objects) == maxKeys {
+				truncated = true
+				return false
+			}
+			objects = append(objects, &StorageObject{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+		}
+		if len(objects) == maxKeys && !lastPage {
+			truncated = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return objects, truncated, nil
+}
+
+func (st *S3Storage) ListPrefixes(prefix string) ([]string, error) {
+	var prefixes []string
+
+	err := st.GetS3Service().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(st.BucketName),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(commonPrefix.Prefix))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+func (st *S3Storage) GetObject(key string) (io.ReadCloser, error) {
+	object, err := st.GetS3Service().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(st.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return object.Body, nil
+}
+
+func (st *S3Storage) GetObjectRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	object, err := st.GetS3Service().GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(st.BucketName),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return object.Body, nil
+}
+
+func (st *S3Storage) StatObject(key string) (*StorageObject, error) {
+	head, err := st.GetS3Service().HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(st.BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+	return &StorageObject{
+		Key:          key,
+		Size:         aws.Int64Value(head.ContentLength),
+		LastModified: aws.TimeValue(head.LastModified),
+	}, nil
+}
+
+func (st *S3Storage) GetObjectUrl(key string) (string, error) {
+	req, _ := st.GetS3Service().GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(st.BucketName),
+		Key:    aws.String(key),
+	})
+	return req.Presign(S3_PRESIGN_DURATION)
+}
+
+func (st *S3Storage) GetObjectDownloadUrl(key string) (string, error) {
+	req, _ := st.GetS3Service().GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(st.BucketName),
+		Key:                        aws.String(key),
+		ResponseContentDisposition: aws.String(attachmentDisposition(key)),
+	})
+	return req.Presign(S3_DOWNLOAD_PRESIGN_DURATION)
+}
+
+// 404's are expected (e.g: albums without an ordering file), so we hand those
+// back as ErrObjectNotFound so callers don't need to know about awserr.
+func translateS3Error(err error) error {
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return ErrObjectNotFound
+	}
+	return err
+}
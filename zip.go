@@ -0,0 +1,138 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Albums with AllowZipDownload serve a ZIP of all their photos at
+// '<album path>_zip', or '<album path>?download=zip'.
+const ALBUM_ZIP_SLUG = "_zip"
+
+const DEFAULT_MAX_ZIP_SIZE_MB = 2048
+
+// ZIP downloads keep a connection to storage open for as long as the
+// visitor takes to download the album, so we only allow a few at a time.
+const MAX_CONCURRENT_ZIP_DOWNLOADS = 2
+
+var zipDownloadSemaphore = make(chan struct{}, MAX_CONCURRENT_ZIP_DOWNLOADS)
+
+func (a *Album) GetMaxZipSize() int64 {
+	if a.MaxZipSize > 0 {
+		return a.MaxZipSize * 1024 * 1024
+	}
+	return DEFAULT_MAX_ZIP_SIZE_MB * 1024 * 1024
+}
+
+// The URL of the album's ZIP download, empty if it doesn't allow one
+func (a *Album) GetZipDownloadUrl() string {
+	if !a.AllowZipDownload {
+		return ""
+	}
+	return a.GetCanonicalUrl().String() + ALBUM_ZIP_SLUG
+}
+
+// Streams the photos of the album, in album order, as a ZIP. Nothing is
+// buffered, each photo is copied from storage straight into the response.
+func handleAlbumZip(album *Album, w http.ResponseWriter, r *http.Request) {
+	if album.HasAuth() && !checkAndRequireAuth(w, r, album) {
+		return
+	}
+
+	if !album.AllowZipDownload {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found\n"))
+		return
+	}
+
+	albumOrdering, err := album.GetOrderedPhotos()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	objects := album.getCachedObjects()
+	var keys []string
+	var totalSize int64
+	for _, photo := range albumOrdering.Ordering {
+		if photo.Slug() == "" {
+			continue
+		}
+		key := album.BucketPrefix + photo.Slug()
+		keys = append(keys, key)
+		if object, ok := objects[key]; ok {
+			totalSize += object.Size
+		}
+	}
+
+	if totalSize > album.GetMaxZipSize() {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("This album is too large to download as a ZIP\n"))
+		return
+	}
+
+	select {
+	case zipDownloadSemaphore <- struct{}{}:
+		defer func() { <-zipDownloadSemaphore }()
+	default:
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Too many downloads in progress, please try again in a minute\n"))
+		return
+	}
+
+	name := path.Base(strings.TrimSuffix(album.Path, "/"))
+	if name == "/" || name == "." {
+		name = "album"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	if album.HasAuth() {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+
+	zipWriter := zip.NewWriter(w)
+	for _, key := range keys {
+		if err := writeObjectToZip(zipWriter, album.site.GetStorage(), key, objects[key]); err != nil {
+			log.Printf("Unable to add %s to ZIP of album %s. Error: %s\n", key, album.Path, err.Error())
+			// the headers are long gone, dropping the connection is the only
+			// way to tell the browser the download failed
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := zipWriter.Close(); err != nil {
+		log.Printf("Unable to finish ZIP of album %s. Error: %s\n", album.Path, err.Error())
+	}
+}
+
+// Photos are already compressed, so they're stored in the ZIP as they are.
+func writeObjectToZip(zipWriter *zip.Writer, storage Storage, key string, object *StorageObject) error {
+	header := &zip.FileHeader{
+		Name:   path.Base(key),
+		Method: zip.Store,
+	}
+	if object != nil {
+		header.Modified = object.LastModified
+	}
+
+	entry, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	reader, err := storage.GetObject(key)
+	if err != nil {
+		return fmt.Errorf("Unable to get %s from storage: %s", key, err.Error())
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(entry, reader)
+	return err
+}